@@ -0,0 +1,111 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/lulf/dings-api/pkg/api"
+)
+
+type windowBody struct {
+	// Window of events to keep, in seconds
+	Window int64 `json:"window"`
+}
+
+// Get or update the event cache pruning window
+func windowHandler(getWindow func() int64, setWindow func(int64) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+		case "POST":
+			var body windowBody
+			err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			err = setWindow(body.Window)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(windowBody{Window: getWindow()})
+	}
+}
+
+type rejectedBody struct {
+	// Number of messages rejected since startup
+	Total    int64                 `json:"total"`
+	Messages []api.RejectedMessage `json:"messages"`
+}
+
+// List the most recently rejected event store messages
+func rejectedHandler(rejected func() ([]api.RejectedMessage, int64)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		messages, total := rejected()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rejectedBody{Total: total, Messages: messages})
+	}
+}
+
+type topicReaderFunc func(topic string, offset int64, max int) ([]api.Event, error)
+
+type replayBody struct {
+	Events []api.Event `json:"events"`
+}
+
+// Read a range of a topic from the event store, given by the topic, fromOffset and maxEvents
+// parameters. The events are returned without being added to the cache.
+func replayHandler(topics []string, readTopic topicReaderFunc, maxEventsPerQuery int) http.HandlerFunc {
+	known := make(map[string]bool)
+	for _, topic := range topics {
+		known[topic] = true
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		params := r.URL.Query()
+		topic := params.Get("topic")
+		if !known[topic] {
+			http.Error(w, fmt.Sprintf("unknown topic %q", topic), http.StatusBadRequest)
+			return
+		}
+		offset, err := strconv.ParseInt(params.Get("fromOffset"), 10, 64)
+		if err != nil || offset < 0 {
+			http.Error(w, fmt.Sprintf("invalid fromOffset %q", params.Get("fromOffset")), http.StatusBadRequest)
+			return
+		}
+		max, err := strconv.Atoi(params.Get("maxEvents"))
+		if err != nil || max <= 0 {
+			http.Error(w, fmt.Sprintf("invalid maxEvents %q", params.Get("maxEvents")), http.StatusBadRequest)
+			return
+		}
+		events, err := readTopic(topic, offset, clampMax(max, maxEventsPerQuery))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(replayBody{Events: events})
+	}
+}
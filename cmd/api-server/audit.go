@@ -0,0 +1,40 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/lulf/dings-api/pkg/api"
+)
+
+// Wrap a device enabler to record each successful change in the audit log, along with the
+// previous state of the device and the principal of the request
+func auditedEnabler(deviceGetter deviceGetterFunc, deviceEnabler deviceEnablerFunc, add func(api.AuditEntry)) deviceEnablerFunc {
+	return func(ctx context.Context, deviceId string, enabled bool) (api.Device, error) {
+		var previous *bool
+		device, err := deviceGetter(ctx, deviceId)
+		if err != nil {
+			log.Printf("Unable to look up enabled state of %s for the audit log: %v", deviceId, err)
+		} else if device != nil {
+			previous = &device.Enabled
+		}
+
+		updated, err := deviceEnabler(ctx, deviceId, enabled)
+		if err != nil {
+			return updated, err
+		}
+		add(api.AuditEntry{
+			Time:            time.Now().UTC().Unix(),
+			DeviceId:        deviceId,
+			PreviousEnabled: previous,
+			Enabled:         updated.Enabled,
+			Principal:       principal(ctx),
+		})
+		return updated, nil
+	}
+}
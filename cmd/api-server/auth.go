@@ -0,0 +1,84 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/lulf/dings-api/pkg/api"
+)
+
+type principalKey struct{}
+
+// Principal recorded for requests authenticated with the bearer token, which does not name a user
+const tokenPrincipal = "api-token"
+
+// Principal recorded for requests forwarding a bearer token to the device registry
+const forwardedTokenPrincipal = "forwarded-token"
+
+// Returns the principal the request was authenticated as, or an empty string if it was not authenticated
+func principal(ctx context.Context) string {
+	name, _ := ctx.Value(principalKey{}).(string)
+	return name
+}
+
+// Wrap a handler requiring either the bearer token or the basic auth credentials, when set.
+// Requests are passed through unauthenticated if neither is configured. Authenticated requests
+// carry the basic auth username, or tokenPrincipal, as their principal.
+func authHandler(token string, username string, password string, next http.Handler) http.Handler {
+	if token == "" && username == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			if secureEqual(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), token) {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, tokenPrincipal)))
+				return
+			}
+		} else if username != "" {
+			u, p, ok := r.BasicAuth()
+			if ok && secureEqual(u, username) && secureEqual(p, password) {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, u)))
+				return
+			}
+		}
+
+		if username != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="dings-api"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dings-api"`)
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// Compare secrets in constant time
+func secureEqual(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// Forward the Authorization header of the request to the device registry, so that registry
+// requests are made on behalf of the caller. Requests without the header use the configured credentials.
+// The registry checks the header, so unless the API server authenticated the request itself, its
+// principal is the basic auth username of the header, or forwardedTokenPrincipal for other schemes.
+func registryAuthHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authorization := r.Header.Get("Authorization"); authorization != "" {
+			ctx := api.WithAuthorization(r.Context(), authorization)
+			if principal(ctx) == "" {
+				name := forwardedTokenPrincipal
+				if u, _, ok := r.BasicAuth(); ok {
+					name = u
+				}
+				ctx = context.WithValue(ctx, principalKey{}, name)
+			}
+			r = r.WithContext(ctx)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
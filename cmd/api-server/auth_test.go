@@ -0,0 +1,44 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegistryAuthPrincipal(t *testing.T) {
+	var got string
+	handler := registryAuthHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = principal(r.Context())
+	}))
+	tests := []struct {
+		name  string
+		setup func(r *http.Request)
+		want  string
+	}{
+		{"without header", func(r *http.Request) {}, ""},
+		{"basic auth", func(r *http.Request) { r.SetBasicAuth("alice", "secret") }, "alice"},
+		{"bearer token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer abc") }, forwardedTokenPrincipal},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/graphql", nil)
+		test.setup(r)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		if got != test.want {
+			t.Errorf("%s: expected principal %q, got %q", test.name, test.want, got)
+		}
+	}
+
+	// The principal authenticated by the API server is kept
+	authenticated := authHandler("", "admin", "pass", handler)
+	r := httptest.NewRequest("POST", "/graphql", nil)
+	r.SetBasicAuth("admin", "pass")
+	authenticated.ServeHTTP(httptest.NewRecorder(), r)
+	if got != "admin" {
+		t.Errorf("expected principal admin, got %q", got)
+	}
+}
@@ -0,0 +1,233 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Configuration of the API server. Fields tagged with redact are masked when the configuration is printed,
+// either entirely (redact:"true") or only the password of a URL (redact:"url").
+type config struct {
+	EventStoreUrl        string `redact:"url"`
+	EventStoreTLS        bool
+	EventStoreCACert     string
+	EventStoreCert       string
+	EventStoreKey        string
+	EventStoreServerName string
+	EventStoreInsecure   bool
+	EventStoreUser       string
+	EventStorePass       string `redact:"true"`
+	ContainerId          string
+	ConnectTimeout       time.Duration
+	Heartbeat            time.Duration
+	ReceiveTimeout       time.Duration
+	Prefetch             int
+	MaxMessageBytes      int
+	FieldAliasesFile     string
+	MetaProperties       string
+	DeviceRegistryUrl    string `redact:"url"`
+	Username             string
+	Password             string `redact:"true"`
+	ForwardAuth          bool
+	DeviceTimeout        time.Duration
+	DeviceMaxIdleConns   int
+	DeviceIdleTimeout    time.Duration
+	DeviceKeepAlives     bool
+	DevicePollInterval   time.Duration
+	ReadyRegistry        bool
+	ReadyRegistryCache   time.Duration
+	ReadyDbCache         time.Duration
+	FilterDisabled       bool
+	EnabledRefresh       time.Duration
+	StreamHeartbeat      time.Duration
+	StreamWriteTimeout   time.Duration
+	Topic                string
+	Offset               string
+	Window               int64
+	PruneAlign           int64
+	PruneInterval        time.Duration
+	MaxEvents            int
+	CompactRepeats       bool
+	Replay               bool
+	ReplayIdle           time.Duration
+	DbUrl                string `redact:"url"`
+	DbRetention          time.Duration
+	CacheFile            string
+	SnapshotInterval     time.Duration
+	ListenAddr           string
+	TLSCert              string
+	TLSKey               string
+	BasePath             string
+	MaxQueryBytes        int64
+	MaxQueryDepth        int
+	StrictContentType    bool
+	ResolveConcurrency   int
+	MaxConcurrentQueries int
+	MaxEventsPerQuery    int
+	AllowAllDevices      bool
+	AccessLog            bool
+	RateLimit            float64
+	RateBurst            int
+	TrustProxy           bool
+	CorsOrigins          string
+	AllowPublish         bool
+	AuditHistory         int
+	ApiToken             string `redact:"true"`
+	ApiUser              string
+	ApiPass              string `redact:"true"`
+	ShutdownTimeout      time.Duration
+	ComputeHeatIndex     bool
+	PrintConfig          bool
+}
+
+const redacted = "***"
+
+// Define the command line flags for the configuration
+func (c *config) registerFlags(flags *flag.FlagSet) {
+	flags.StringVar(&c.EventStoreUrl, "a", "127.0.0.1:5672", "Address of AMQP event store")
+	flags.BoolVar(&c.EventStoreTLS, "a-tls", false, "Connect to the event store using TLS")
+	flags.StringVar(&c.EventStoreCACert, "a-cacert", "", "CA certificate for verifying the event store (defaults to system roots)")
+	flags.StringVar(&c.EventStoreCert, "a-cert", "", "Client certificate for the event store")
+	flags.StringVar(&c.EventStoreKey, "a-key", "", "Client key for the event store")
+	flags.StringVar(&c.EventStoreServerName, "a-servername", "", "Expected event store server name (defaults to host of -a)")
+	flags.BoolVar(&c.EventStoreInsecure, "a-insecure", false, "Skip event store certificate verification (testing only)")
+	flags.StringVar(&c.EventStoreUser, "a-user", "", "Event store SASL username (anonymous if empty)")
+	flags.StringVar(&c.EventStorePass, "a-pass", "", "Event store SASL password")
+	flags.StringVar(&c.ContainerId, "container-id", defaultContainerId(), "AMQP container id used when connecting to the event store")
+	flags.DurationVar(&c.ConnectTimeout, "connect-timeout", time.Minute, "Time to keep retrying the initial event store connection (0 = no retries)")
+	flags.DurationVar(&c.Heartbeat, "heartbeat", 30*time.Second, "Maximum delay between frames requested from the event store, the connection is closed after twice this delay without frames (0 = disabled)")
+	flags.DurationVar(&c.ReceiveTimeout, "receive-timeout", 5*time.Minute, "Time without messages on a topic after which the link is checked, and reconnected if heartbeats are disabled (0 = never)")
+	flags.IntVar(&c.Prefetch, "prefetch", 100, "Number of messages per topic the event store may send ahead of processing (0 = one at a time)")
+	flags.IntVar(&c.MaxMessageBytes, "max-message-bytes", 64*1024, "Maximum size of an event store message body, larger messages are rejected (0 = unlimited)")
+	flags.StringVar(&c.FieldAliasesFile, "field-aliases", "", "JSON file with event data key renames applied on ingest, e.g. {\"temp\": \"temperature\"}")
+	flags.StringVar(&c.MetaProperties, "meta-properties", "", "Comma-separated list of message application properties and annotations to keep in the meta of events")
+	flags.StringVar(&c.DeviceRegistryUrl, "d", "", "Comma-separated list of [name=]url Device Registration APIs, in order of preference")
+	flags.StringVar(&c.Username, "u", "", "Device registry username")
+	flags.StringVar(&c.Password, "p", "", "Device registry password")
+	flags.BoolVar(&c.ForwardAuth, "forward-auth", false, "Forward the Authorization header of GraphQL requests to the device registry instead of -u and -p")
+	flags.DurationVar(&c.DeviceTimeout, "device-timeout", 10*time.Second, "Timeout for device registry requests")
+	flags.IntVar(&c.DeviceMaxIdleConns, "device-max-idle-conns", 10, "Maximum number of idle connections kept open to the device registry")
+	flags.DurationVar(&c.DeviceIdleTimeout, "device-idle-timeout", 90*time.Second, "Time an idle device registry connection is kept open (0 = no limit)")
+	flags.BoolVar(&c.DeviceKeepAlives, "device-keepalives", true, "Reuse connections to the device registry between requests")
+	flags.DurationVar(&c.DevicePollInterval, "device-poll-interval", 30*time.Second, "Interval between device registry polls for the device change stream (0 = disabled)")
+	flags.BoolVar(&c.ReadyRegistry, "ready-registry", true, "Report the server as not ready while the device registry is unreachable")
+	flags.DurationVar(&c.ReadyRegistryCache, "ready-registry-cache", 5*time.Second, "Time the result of the device registry readiness check is reused (0 = check on every request)")
+	flags.DurationVar(&c.ReadyDbCache, "ready-db-cache", 5*time.Second, "Time the result of the -db-url readiness check is reused (0 = check on every request)")
+	flags.BoolVar(&c.FilterDisabled, "filter-disabled", false, "Leave events from devices that are unknown or disabled in the device registry out of event queries")
+	flags.DurationVar(&c.EnabledRefresh, "enabled-refresh", time.Minute, "Interval between refreshes of the enabled devices used by -filter-disabled")
+	flags.DurationVar(&c.StreamHeartbeat, "stream-heartbeat", 15*time.Second, "Interval between heartbeats on idle event streams")
+	flags.DurationVar(&c.StreamWriteTimeout, "stream-write-timeout", 10*time.Second, "Time a write to an event stream may take before the stream is closed (0 = no limit)")
+	flags.StringVar(&c.Topic, "t", "events", "Comma-separated list of event store topics")
+	flags.StringVar(&c.Offset, "o", "0", "Event store offset, earliest, latest or @<timestamp> (defaults to the offset saved in -cache-file)")
+	flags.Int64Var(&c.Window, "w", 172800, "Window of data to keep (in seconds)")
+	flags.Int64Var(&c.PruneAlign, "prune-align", 0, "Start the window at a multiple of this many seconds, pruning whole buckets at a time (0 = rolling window)")
+	flags.DurationVar(&c.PruneInterval, "prune-interval", 0, "Interval between prunes of events outside the window, in addition to pruning as events arrive (0 = a tenth of the window)")
+	flags.IntVar(&c.MaxEvents, "max-events", 0, "Maximum number of events to keep (0 = unlimited)")
+	flags.BoolVar(&c.CompactRepeats, "compact-repeats", false, "Collapse consecutive events from a device with identical data into one event")
+	flags.BoolVar(&c.Replay, "replay", false, "Replay events from the event store for each query instead of keeping them in memory")
+	flags.DurationVar(&c.ReplayIdle, "replay-idle", 2*time.Second, "Time without messages after which a topic is considered replayed by -replay and /admin/replay, so each query in -replay mode takes at least this long per topic")
+	flags.StringVar(&c.ListenAddr, "l", ":8080", "Address to listen on for HTTP requests")
+	flags.StringVar(&c.ListenAddr, "listen", ":8080", "Address to listen on for HTTP requests")
+	flags.StringVar(&c.TLSCert, "tls-cert", "", "Certificate for serving HTTPS and HTTP/2 (requires -tls-key)")
+	flags.StringVar(&c.TLSKey, "tls-key", "", "Private key for -tls-cert")
+	flags.StringVar(&c.BasePath, "base-path", "", "Path prefix for all HTTP routes, e.g. /api/dings")
+	flags.Int64Var(&c.MaxQueryBytes, "max-query-bytes", 1<<20, "Maximum size of a GraphQL request body")
+	flags.IntVar(&c.MaxQueryDepth, "max-query-depth", 10, "Maximum nesting depth of a GraphQL query (0 = unlimited)")
+	flags.BoolVar(&c.StrictContentType, "strict-content-type", true, "Answer GraphQL POST requests that are not application/json or application/graphql with 415")
+	flags.IntVar(&c.MaxEventsPerQuery, "max-events-per-query", 1000, "Maximum number of events returned by a query, also applied when no max is given (0 = unlimited)")
+	flags.BoolVar(&c.AllowAllDevices, "allow-all-devices-query", true, "Allow event queries without a deviceId or group, which return events of all devices")
+	flags.IntVar(&c.ResolveConcurrency, "resolve-concurrency", 8, "Maximum number of per-device fields resolved concurrently")
+	flags.IntVar(&c.MaxConcurrentQueries, "max-concurrent-queries", 100, "Maximum number of GraphQL requests served at a time, others are rejected with 503 (0 = unlimited)")
+	flags.BoolVar(&c.AccessLog, "access-log", true, "Log each HTTP request with its status, size and duration")
+	flags.Float64Var(&c.RateLimit, "rate-limit", 0, "Maximum number of HTTP requests per second from a client IP, others are rejected with 429 (0 = unlimited)")
+	flags.IntVar(&c.RateBurst, "rate-burst", 20, "Number of requests a client may make at once before -rate-limit applies")
+	flags.BoolVar(&c.TrustProxy, "trust-proxy", false, "Take the client IP for -rate-limit from the X-Forwarded-For header set by a proxy in front of the server")
+	flags.StringVar(&c.CorsOrigins, "cors-origins", "*", "Comma-separated list of origins allowed to make cross-origin requests")
+	flags.BoolVar(&c.AllowPublish, "allow-publish", false, "Allow injecting events into the cache with the publishEvent mutation")
+	flags.IntVar(&c.AuditHistory, "audit-history", 1000, "Number of device enabled state changes kept in the audit log")
+	flags.StringVar(&c.ApiToken, "api-token", "", "Bearer token required for GraphQL requests")
+	flags.StringVar(&c.ApiUser, "api-user", "", "Basic auth username required for GraphQL requests")
+	flags.StringVar(&c.ApiPass, "api-pass", "", "Basic auth password required for GraphQL requests")
+	flags.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", 10*time.Second, "Time to wait for in-flight requests on shutdown")
+	flags.StringVar(&c.DbUrl, "db-url", "", "postgres:// or sqlite:// URL of a database to store received events in and serve event queries from, instead of the in-memory cache")
+	flags.DurationVar(&c.DbRetention, "db-retention", 0, "Time events are kept in the -db-url database before they are deleted (0 = keep all events)")
+	flags.StringVar(&c.CacheFile, "cache-file", "", "File to persist the event cache to between restarts")
+	flags.DurationVar(&c.SnapshotInterval, "cache-interval", time.Minute, "Interval between event cache snapshots (0 = only on shutdown)")
+	flags.BoolVar(&c.ComputeHeatIndex, "heat-index", false, "Compute the heat index from temperature and humidity when not sent by the device")
+	flags.BoolVar(&c.PrintConfig, "print-config", false, "Log the effective configuration at startup, with secrets redacted")
+}
+
+// Returns the configuration as one name=value line per field, with secrets redacted
+func (c config) String() string {
+	var lines []string
+	v := reflect.ValueOf(c)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		value := fmt.Sprintf("%v", v.Field(i).Interface())
+		switch field.Tag.Get("redact") {
+		case "true":
+			if value != "" {
+				value = redacted
+			}
+		case "url":
+			var urls []string
+			for _, u := range strings.Split(value, ",") {
+				urls = append(urls, redactURL(u))
+			}
+			value = strings.Join(urls, ",")
+		}
+		lines = append(lines, fmt.Sprintf("%s=%s", field.Name, value))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Query parameters and connection string keys holding a password, in lower case
+var passwordKeys = map[string]bool{"password": true, "_auth_pass": true}
+
+// A password in a key=value connection string such as "host=db password=secret", possibly quoted
+var keyValuePassword = regexp.MustCompile(`(?i)((?:^|\s)(?:password|_auth_pass)\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
+
+// Masks the password of a URL, in its user info or query parameters, or of a key=value connection
+// string. The URL may be prefixed by a name=.
+func redactURL(value string) string {
+	if !strings.Contains(value, "://") {
+		return keyValuePassword.ReplaceAllString(value, "${1}"+redacted)
+	}
+	if eq := strings.Index(value, "="); eq >= 0 && !strings.Contains(value[:eq], "/") {
+		return value[:eq+1] + redactURL(value[eq+1:])
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return value
+	}
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			username := url.User(u.User.Username()).String()
+			value = strings.Replace(value, u.User.String()+"@", username+":"+redacted+"@", 1)
+		}
+	}
+	if u.RawQuery != "" {
+		params := strings.Split(u.RawQuery, "&")
+		for i, param := range params {
+			key := param
+			if eq := strings.Index(param, "="); eq >= 0 {
+				key = param[:eq]
+			}
+			if name, err := url.QueryUnescape(key); err == nil && passwordKeys[strings.ToLower(name)] {
+				params[i] = key + "=" + redacted
+			}
+		}
+		value = strings.Replace(value, "?"+u.RawQuery, "?"+strings.Join(params, "&"), 1)
+	}
+	return value
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Environment variables read for flags that are not given on the command line
+var flagEnvironment = map[string]string{
+	"a":                       "DINGS_EVENTSTORE_URL",
+	"a-tls":                   "DINGS_EVENTSTORE_TLS",
+	"a-cacert":                "DINGS_EVENTSTORE_CACERT",
+	"a-cert":                  "DINGS_EVENTSTORE_CERT",
+	"a-key":                   "DINGS_EVENTSTORE_KEY",
+	"a-servername":            "DINGS_EVENTSTORE_SERVERNAME",
+	"a-insecure":              "DINGS_EVENTSTORE_INSECURE",
+	"a-user":                  "DINGS_EVENTSTORE_USERNAME",
+	"a-pass":                  "DINGS_EVENTSTORE_PASSWORD",
+	"container-id":            "DINGS_CONTAINER_ID",
+	"connect-timeout":         "DINGS_CONNECT_TIMEOUT",
+	"heartbeat":               "DINGS_HEARTBEAT",
+	"receive-timeout":         "DINGS_RECEIVE_TIMEOUT",
+	"prefetch":                "DINGS_PREFETCH",
+	"max-message-bytes":       "DINGS_MAX_MESSAGE_BYTES",
+	"field-aliases":           "DINGS_FIELD_ALIASES",
+	"meta-properties":         "DINGS_META_PROPERTIES",
+	"d":                       "DINGS_DEVICE_REGISTRY_URL",
+	"u":                       "DINGS_USERNAME",
+	"p":                       "DINGS_PASSWORD",
+	"forward-auth":            "DINGS_FORWARD_AUTH",
+	"device-timeout":          "DINGS_DEVICE_TIMEOUT",
+	"device-max-idle-conns":   "DINGS_DEVICE_MAX_IDLE_CONNS",
+	"device-idle-timeout":     "DINGS_DEVICE_IDLE_TIMEOUT",
+	"device-keepalives":       "DINGS_DEVICE_KEEPALIVES",
+	"device-poll-interval":    "DINGS_DEVICE_POLL_INTERVAL",
+	"ready-registry":          "DINGS_READY_REGISTRY",
+	"ready-registry-cache":    "DINGS_READY_REGISTRY_CACHE",
+	"ready-db-cache":          "DINGS_READY_DB_CACHE",
+	"filter-disabled":         "DINGS_FILTER_DISABLED",
+	"enabled-refresh":         "DINGS_ENABLED_REFRESH",
+	"stream-heartbeat":        "DINGS_STREAM_HEARTBEAT",
+	"stream-write-timeout":    "DINGS_STREAM_WRITE_TIMEOUT",
+	"t":                       "DINGS_TOPICS",
+	"o":                       "DINGS_OFFSET",
+	"w":                       "DINGS_WINDOW",
+	"prune-align":             "DINGS_PRUNE_ALIGN",
+	"prune-interval":          "DINGS_PRUNE_INTERVAL",
+	"max-events":              "DINGS_MAX_EVENTS",
+	"compact-repeats":         "DINGS_COMPACT_REPEATS",
+	"replay":                  "DINGS_REPLAY",
+	"replay-idle":             "DINGS_REPLAY_IDLE",
+	"l":                       "DINGS_LISTEN",
+	"listen":                  "DINGS_LISTEN",
+	"tls-cert":                "DINGS_TLS_CERT",
+	"tls-key":                 "DINGS_TLS_KEY",
+	"base-path":               "DINGS_BASE_PATH",
+	"max-query-bytes":         "DINGS_MAX_QUERY_BYTES",
+	"max-query-depth":         "DINGS_MAX_QUERY_DEPTH",
+	"strict-content-type":     "DINGS_STRICT_CONTENT_TYPE",
+	"max-events-per-query":    "DINGS_MAX_EVENTS_PER_QUERY",
+	"allow-all-devices-query": "DINGS_ALLOW_ALL_DEVICES_QUERY",
+	"resolve-concurrency":     "DINGS_RESOLVE_CONCURRENCY",
+	"max-concurrent-queries":  "DINGS_MAX_CONCURRENT_QUERIES",
+	"access-log":              "DINGS_ACCESS_LOG",
+	"rate-limit":              "DINGS_RATE_LIMIT",
+	"rate-burst":              "DINGS_RATE_BURST",
+	"trust-proxy":             "DINGS_TRUST_PROXY",
+	"cors-origins":            "DINGS_CORS_ORIGINS",
+	"allow-publish":           "DINGS_ALLOW_PUBLISH",
+	"audit-history":           "DINGS_AUDIT_HISTORY",
+	"api-token":               "DINGS_API_TOKEN",
+	"api-user":                "DINGS_API_USERNAME",
+	"api-pass":                "DINGS_API_PASSWORD",
+	"shutdown-timeout":        "DINGS_SHUTDOWN_TIMEOUT",
+	"db-url":                  "DINGS_DB_URL",
+	"db-retention":            "DINGS_DB_RETENTION",
+	"cache-file":              "DINGS_CACHE_FILE",
+	"cache-interval":          "DINGS_CACHE_INTERVAL",
+	"heat-index":              "DINGS_HEAT_INDEX",
+	"print-config":            "DINGS_PRINT_CONFIG",
+}
+
+// Set flags that were not given on the command line from their environment variable.
+// Flags sharing an environment variable are skipped if any of them was given.
+func applyEnvironment(flags *flag.FlagSet, environment map[string]string) error {
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		if key, ok := environment[f.Name]; ok {
+			given[key] = true
+		}
+	})
+	for name, key := range environment {
+		value, ok := os.LookupEnv(key)
+		if !ok || given[key] {
+			continue
+		}
+		err := flags.Set(name, value)
+		if err != nil {
+			return fmt.Errorf("invalid value %q for %s: %v", value, key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/lulf/dings-api/pkg/api"
+)
+
+type eventStreamerFunc func(api.EventQuery, func(api.Event) error) error
+
+// Number of exported events written between flushes
+const exportFlushInterval = 100
+
+// Export the events matching the deviceId, since and until parameters as JSON Lines, oldest first.
+// Exports without deviceId are rejected unless allowAllDevices is set.
+func exportHandler(streamEvents eventStreamerFunc, allowAllDevices bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		params := r.URL.Query()
+		query := api.EventQuery{DeviceId: params.Get("deviceId")}
+		if query.DeviceId == "" && !allowAllDevices {
+			http.Error(w, "deviceId is required, exports of all devices are disabled", http.StatusBadRequest)
+			return
+		}
+		var err error
+		query.Since, err = timestampParam(params.Get("since"))
+		if err == nil {
+			query.Until, err = timestampParam(params.Get("until"))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Validate before the response is started, so that invalid queries get an error status
+		err = query.Validate()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		flusher, _ := w.(http.Flusher)
+		encoder := json.NewEncoder(w)
+		written := 0
+		err = streamEvents(query, func(e api.Event) error {
+			err := encoder.Encode(e)
+			if err != nil {
+				return err
+			}
+			written++
+			if flusher != nil && written%exportFlushInterval == 0 {
+				flusher.Flush()
+			}
+			return r.Context().Err()
+		})
+		// The status is already sent, so errors can only end the response early
+		if err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// Parse an optional timestamp parameter in seconds since the Unix epoch
+func timestampParam(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	t, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timestamp %q", value)
+	}
+	return t, nil
+}
@@ -0,0 +1,37 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Seconds a client is asked to wait before retrying a rejected query
+const overloadRetryAfter = "1"
+
+var queriesRejected = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "dings_queries_rejected_total",
+	Help: "Number of GraphQL requests rejected because the maximum number of concurrent queries was reached",
+})
+
+// Wrap a handler to serve at most max requests at a time. Requests beyond that are rejected with
+// 503 instead of queueing, so that a burst of queries does not pile up on the event cache.
+func concurrencyLimitHandler(max int, next http.Handler) http.Handler {
+	slots := make(chan struct{}, max)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+		default:
+			queriesRejected.Inc()
+			w.Header().Set("Retry-After", overloadRetryAfter)
+			http.Error(w, "too many concurrent queries", http.StatusServiceUnavailable)
+			return
+		}
+		defer func() { <-slots }()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -5,66 +5,280 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"log"
+	"mime"
+	"net"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"time"
 
 	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
 	"github.com/lulf/dings-api/pkg/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/sync/errgroup"
 )
 
 type queryBody struct {
-	Query string `json:"query"`
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+	// Only parse and validate the query, set from the validateOnly parameter
+	ValidateOnly bool `json:"-"`
 }
 
-type deviceFetcherFunc func() ([]api.Device, error)
-type eventFetcherFunc func(string, int, int64) ([]api.Event, error)
+type deviceFetcherFunc func(context.Context) ([]api.Device, error)
+type deviceGetterFunc func(context.Context, string) (*api.Device, error)
+type eventFetcherFunc func(api.EventQuery) ([]api.Event, error)
+type eventListerFunc func(api.EventQuery) (api.EventList, error)
+type latestEventFetcherFunc func(string) (*api.Event, error)
+type deviceEnablerFunc func(context.Context, string, bool) (api.Device, error)
+type deviceUpdaterFunc func(context.Context, string, api.DevicePatch) (api.Device, error)
+type eventPublisherFunc func(api.Event)
+type auditListerFunc func(string) []api.AuditEntry
 
-func createSchema(deviceFetcher deviceFetcherFunc, eventFetcher eventFetcherFunc) graphql.Schema {
-	var deviceType = graphql.NewObject(
-		graphql.ObjectConfig{
-			Name: "Device",
-			Fields: graphql.Fields{
-				"id": &graphql.Field{
-					Type: graphql.String,
-					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
-						d := p.Source.(api.Device)
-						return d.ID, nil
-					},
-				},
-				"enabled": &graphql.Field{
-					Type: graphql.Boolean,
-				},
-				"name": &graphql.Field{
-					Type: graphql.String,
-				},
-				"description": &graphql.Field{
-					Type: graphql.String,
-				},
-				"sensors": &graphql.Field{
-					Type: graphql.NewList(graphql.String),
-				},
-			},
+// A device with its latest event resolved ahead of the latestEvent field
+type deviceNode struct {
+	api.Device
+	latestEvent *api.Event
+}
+
+// Resolve the remaining device fields from the embedded device
+func (n deviceNode) Resolve(p graphql.ResolveParams) (interface{}, error) {
+	p.Source = n.Device
+	return graphql.DefaultResolveFn(p)
+}
+
+// Returns the device of a Device field source
+func sourceDevice(source interface{}) api.Device {
+	if node, ok := source.(deviceNode); ok {
+		return node.Device
+	}
+	return source.(api.Device)
+}
+
+// Returns true if the field selects the given sub field directly
+func selectsField(p graphql.ResolveParams, name string) bool {
+	for _, fieldAST := range p.Info.FieldASTs {
+		if fieldAST.SelectionSet == nil {
+			continue
+		}
+		for _, selection := range fieldAST.SelectionSet.Selections {
+			if field, ok := selection.(*ast.Field); ok && field.Name != nil && field.Name.Value == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// List the events matching the query for all devices in the group, with the total number of matches
+func groupEventList(ctx context.Context, deviceFetcher deviceFetcherFunc, eventLister eventListerFunc, group string, query api.EventQuery) (api.EventList, error) {
+	devices, err := deviceFetcher(ctx)
+	if err != nil {
+		return api.EventList{}, err
+	}
+	total := 0
+	var lists [][]api.Event
+	for _, id := range api.GroupDeviceIds(devices, group) {
+		query.DeviceId = id
+		var list api.EventList
+		err := traceListEvents(ctx, query, func() (err error) {
+			list, err = eventLister(query)
+			return err
+		})
+		if err != nil {
+			return api.EventList{}, err
+		}
+		total += list.TotalCount
+		lists = append(lists, list.Events)
+	}
+	return api.EventList{TotalCount: total, Events: api.MergeEvents(lists, query.Order, query.Max)}, nil
+}
+
+// Apply the ceiling to a requested max number of events. A max of 0 means the ceiling, and a ceiling
+// of 0 means no limit. Negative values are left for the query validation to reject.
+func clampMax(max int, ceiling int) int {
+	if ceiling <= 0 || max < 0 {
+		return max
+	}
+	if max == 0 {
+		return ceiling
+	}
+	if max > ceiling {
+		log.Printf("Clamping requested max of %d events to %d", max, ceiling)
+		return ceiling
+	}
+	return max
+}
+
+// Returns the field of the Data type for a scalar sensor
+func scalarSensorField(sensor api.ScalarSensor) *graphql.Field {
+	var fieldType graphql.Output = graphql.Float
+	if sensor.Type == api.IntScalar {
+		fieldType = graphql.Int
+	}
+	return &graphql.Field{
+		Type:        fieldType,
+		Description: sensor.Description,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			if data, ok := p.Source.(api.EventData); ok {
+				if value, ok := data.Scalars[sensor.Name]; ok {
+					return value, nil
+				}
+			}
+			return nil, nil
 		},
-	)
+	}
+}
+
+// Returns nil for an empty string, for optional fields that are not set
+func emptyAsNull(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
+
+// A device label, as exposed in the schema
+type label struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Returns the device filter given by the arguments of a device list query
+func deviceFilter(args map[string]interface{}) api.DeviceFilter {
+	filter := api.DeviceFilter{}
+	filter.NameContains, _ = args["nameContains"].(string)
+	filter.HasSensor, _ = args["hasSensor"].(string)
+	if enabled, ok := args["enabled"].(bool); ok {
+		filter.Enabled = &enabled
+	}
+	return filter
+}
+
+// List the events matching the query for all devices in the group, merged by creation time
+func groupEvents(ctx context.Context, deviceFetcher deviceFetcherFunc, eventFetcher eventFetcherFunc, group string, query api.EventQuery) ([]api.Event, error) {
+	devices, err := deviceFetcher(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var lists [][]api.Event
+	for _, id := range api.GroupDeviceIds(devices, group) {
+		query.DeviceId = id
+		events, err := tracedListEvents(ctx, eventFetcher, query)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, events)
+	}
+	return api.MergeEvents(lists, query.Order, query.Max), nil
+}
+
+// Fetch the latest event of each device concurrently, with at most concurrency fetches in flight
+func resolveLatestEvents(ctx context.Context, devices []api.Device, latestEventFetcher latestEventFetcherFunc, concurrency int) ([]deviceNode, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	nodes := make([]deviceNode, len(devices))
+	sem := make(chan struct{}, concurrency)
+	group, ctx := errgroup.WithContext(ctx)
+	for i := range devices {
+		i := i
+		nodes[i].Device = devices[i]
+		group.Go(func() error {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			defer func() { <-sem }()
+			e, err := latestEventFetcher(devices[i].ID)
+			if err != nil {
+				return err
+			}
+			nodes[i].latestEvent = e
+			return nil
+		})
+	}
+	err := group.Wait()
+	if err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// Returns the event a field is resolved on, or false if the source is not an event
+func eventSource(source interface{}) (api.Event, bool) {
+	switch e := source.(type) {
+	case api.Event:
+		return e, true
+	case *api.Event:
+		if e != nil {
+			return *e, true
+		}
+	}
+	return api.Event{}, false
+}
 
+// Create the schema serving the events of the event store. The cache information queries fail if
+// cache is nil, as when events are not kept in memory.
+func createSchema(deviceFetcher deviceFetcherFunc, deviceGetter deviceGetterFunc, events api.EventStore, cache api.CacheInspector, deviceEnabler deviceEnablerFunc, deviceUpdater deviceUpdaterFunc, eventPublisher eventPublisherFunc, auditLister auditListerFunc, computeHeatIndex bool, resolveConcurrency int, maxEventsPerQuery int, allowAllDevices bool) graphql.Schema {
+	var eventFetcher eventFetcherFunc = events.ListEvents
+	var eventLister eventListerFunc = events.ListEventsCounted
+	var latestEventFetcher latestEventFetcherFunc = events.LatestEvent
 	var temperatureType = graphql.NewObject(
 		graphql.ObjectConfig{
 			Name: "Temperature",
 			Fields: graphql.Fields{
-				"celcius": &graphql.Field{
+				"celsius": &graphql.Field{
 					Type: graphql.Float,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						if t, ok := p.Source.(*api.Temperature); ok {
+							return t.Celcius, nil
+						}
+						return nil, nil
+					},
+				},
+				"celcius": &graphql.Field{
+					Type:              graphql.Float,
+					DeprecationReason: "Use celsius",
 				},
 				"humidity": &graphql.Field{
 					Type: graphql.Float,
 				},
-				"heatindexCelcius": &graphql.Field{
+				"heatIndexCelsius": &graphql.Field{
 					Type: graphql.Float,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						if t, ok := p.Source.(*api.Temperature); ok {
+							return t.HeatindexCelcius, nil
+						}
+						return nil, nil
+					},
+				},
+				"heatindexCelcius": &graphql.Field{
+					Type:              graphql.Float,
+					DeprecationReason: "Use heatIndexCelsius",
 				},
 			},
 		})
@@ -78,6 +292,12 @@ func createSchema(deviceFetcher deviceFetcherFunc, eventFetcher eventFetcherFunc
 				},
 				"humidity": &graphql.Field{
 					Type: graphql.NewList(graphql.Float),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						if soil, ok := p.Source.(*api.Soil); ok && soil.Humidity != nil {
+							return soil.Humidity, nil
+						}
+						return nil, nil
+					},
 				},
 			},
 		})
@@ -88,15 +308,40 @@ func createSchema(deviceFetcher deviceFetcherFunc, eventFetcher eventFetcherFunc
 			Fields: graphql.Fields{
 				"motion": &graphql.Field{
 					Type: graphql.Boolean,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						if data, ok := p.Source.(api.EventData); ok && data.Motion != nil {
+							return *data.Motion, nil
+						}
+						return nil, nil
+					},
 				},
 				"temperature": &graphql.Field{
 					Type: temperatureType,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						if data, ok := p.Source.(api.EventData); ok && data.Temperature != nil {
+							return data.Temperature, nil
+						}
+						return nil, nil
+					},
 				},
 				"soil": &graphql.Field{
 					Type: soilType,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						if data, ok := p.Source.(api.EventData); ok && data.Soil != nil {
+							return data.Soil, nil
+						}
+						return nil, nil
+					},
+				},
+				"raw": &graphql.Field{
+					Type:        jsonType,
+					Description: "All event data, including sensors without a typed field",
 				},
 			},
 		})
+	for _, sensor := range api.ScalarSensors {
+		eventDataType.AddFieldConfig(sensor.Name, scalarSensorField(sensor))
+	}
 
 	var eventType = graphql.NewObject(
 		graphql.ObjectConfig{
@@ -105,145 +350,1614 @@ func createSchema(deviceFetcher deviceFetcherFunc, eventFetcher eventFetcherFunc
 				"deviceId": &graphql.Field{
 					Type: graphql.String,
 				},
+				"topic": &graphql.Field{
+					Type: graphql.String,
+				},
 				"creationTime": &graphql.Field{
-					Type: graphql.Int,
+					Type: timestampType,
+				},
+				"creationTimeISO": &graphql.Field{
+					Type: graphql.String,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						e, ok := eventSource(p.Source)
+						if !ok {
+							return nil, nil
+						}
+						return time.Unix(e.CreationTime, 0).UTC().Format(time.RFC3339), nil
+					},
+				},
+				"count": &graphql.Field{
+					Type:        graphql.Int,
+					Description: "Number of identical readings collapsed into the event, 1 unless compacted",
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						e, ok := eventSource(p.Source)
+						if !ok {
+							return nil, nil
+						}
+						return e.Count(), nil
+					},
+				},
+				"firstSeen": &graphql.Field{
+					Type: timestampType,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						e, ok := eventSource(p.Source)
+						if !ok {
+							return nil, nil
+						}
+						return e.CreationTime, nil
+					},
+				},
+				"lastSeen": &graphql.Field{
+					Type: timestampType,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						e, ok := eventSource(p.Source)
+						if !ok {
+							return nil, nil
+						}
+						return e.LastSeen(), nil
+					},
+				},
+				"meta": &graphql.Field{
+					Type:        jsonType,
+					Description: "Message properties and annotations captured on ingest, selected by -meta-properties",
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						e, ok := eventSource(p.Source)
+						if !ok || len(e.Meta) == 0 {
+							return nil, nil
+						}
+						return e.Meta, nil
+					},
 				},
 				"data": &graphql.Field{
 					Type: eventDataType,
 					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
-						e := p.Source.(api.Event)
-						return e.Data, nil
+						e, ok := eventSource(p.Source)
+						if !ok {
+							return nil, nil
+						}
+						data := e.DecodedData()
+						if computeHeatIndex && data.Temperature != nil {
+							data.Temperature.ComputeHeatIndex()
+						}
+						return data, nil
 					},
 				},
 			},
 		},
 	)
 
-	var queryType = graphql.NewObject(
+	var sensorType = graphql.NewObject(
 		graphql.ObjectConfig{
-			Name: "Query",
+			Name: "Sensor",
 			Fields: graphql.Fields{
-				"devices": &graphql.Field{
-					Type: graphql.NewList(deviceType),
+				"name": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.String),
+				},
+				"type": &graphql.Field{
+					Type: graphql.String,
 					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
-						data, err := deviceFetcher()
-						return data, err
+						return emptyAsNull(p.Source.(api.Sensor).Type), nil
 					},
 				},
-				"events": &graphql.Field{
-					Type: graphql.NewList(eventType),
-					Args: graphql.FieldConfigArgument{
-						"deviceId": &graphql.ArgumentConfig{
-							Type: graphql.String,
-						},
-						"since": &graphql.ArgumentConfig{
-							Type:         graphql.Int,
-							DefaultValue: 0,
-						},
-						"max": &graphql.ArgumentConfig{
-							Type:         graphql.Int,
-							DefaultValue: 0,
-						},
-					},
+				"unit": &graphql.Field{
+					Type: graphql.String,
 					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
-						max := p.Args["max"].(int)
-						since := p.Args["since"].(int)
-
-						deviceId, ok := p.Args["deviceId"].(string)
-						if ok {
-							return eventFetcher(deviceId, max, int64(since))
-						}
-						return nil, nil
+						return emptyAsNull(p.Source.(api.Sensor).Unit), nil
 					},
 				},
 			},
-		})
-
-	var schema, _ = graphql.NewSchema(
-		graphql.SchemaConfig{
-			Query: queryType,
 		},
 	)
-	return schema
-}
 
-func executeQuery(query string, schema graphql.Schema) *graphql.Result {
-	result := graphql.Do(graphql.Params{
-		Schema:        schema,
-		RequestString: query,
-	})
-	if len(result.Errors) > 0 {
-		log.Printf("wrong result, unexpected errors: %v", result.Errors)
-	}
-	return result
-}
+	var labelType = graphql.NewObject(
+		graphql.ObjectConfig{
+			Name: "Label",
+			Fields: graphql.Fields{
+				"key": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.String),
+				},
+				"value": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.String),
+				},
+			},
+		},
+	)
 
-func main() {
-	var eventStoreUrl string
-	var topic string
-	var offset int64
-	var window int64
-	var deviceRegistryUrl string
-	var username string
-	var password string
-	flag.StringVar(&eventStoreUrl, "a", "127.0.0.1:5672", "Address of AMQP event store")
-	flag.StringVar(&deviceRegistryUrl, "d", "", "Device Registration API")
-	flag.StringVar(&username, "u", "", "Device registry username")
-	flag.StringVar(&password, "p", "", "Device registry password")
-	flag.StringVar(&topic, "t", "events", "Event store topic")
-	flag.Int64Var(&offset, "o", 0, "Event store offset")
-	flag.Int64Var(&window, "w", 172800, "Window of data to keep (in seconds)")
+	var deviceType = graphql.NewObject(
+		graphql.ObjectConfig{
+			Name: "Device",
+			Fields: graphql.Fields{
+				"id": &graphql.Field{
+					Type: graphql.String,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return sourceDevice(p.Source).ID, nil
+					},
+				},
+				"enabled": &graphql.Field{
+					Type: graphql.Boolean,
+				},
+				"name": &graphql.Field{
+					Type: graphql.String,
+				},
+				"description": &graphql.Field{
+					Type: graphql.String,
+				},
+				"sensors": &graphql.Field{
+					Type: graphql.NewList(graphql.String),
+				},
+				"sensorDetails": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(sensorType))),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						device := sourceDevice(p.Source)
+						if device.SensorDetails != nil {
+							return device.SensorDetails, nil
+						}
+						// Devices that were not decoded from a registry response only have sensor names
+						sensors := make([]api.Sensor, 0, len(device.Sensors))
+						for _, name := range device.Sensors {
+							sensors = append(sensors, api.Sensor{Name: name})
+						}
+						return sensors, nil
+					},
+				},
+				"source": &graphql.Field{
+					Type: graphql.String,
+				},
+				"labels": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(labelType))),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						labels := sourceDevice(p.Source).Labels
+						ret := make([]label, 0, len(labels))
+						for key, value := range labels {
+							ret = append(ret, label{Key: key, Value: value})
+						}
+						sort.Slice(ret, func(i, j int) bool { return ret[i].Key < ret[j].Key })
+						return ret, nil
+					},
+				},
+				"metadata": &graphql.Field{
+					Type: jsonType,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						metadata := sourceDevice(p.Source).Metadata
+						if metadata == nil {
+							return nil, nil
+						}
+						return map[string]string(metadata), nil
+					},
+				},
+				"latestEvent": &graphql.Field{
+					Type: eventType,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						var e *api.Event
+						if node, ok := p.Source.(deviceNode); ok {
+							e = node.latestEvent
+						} else {
+							var err error
+							e, err = latestEventFetcher(p.Source.(api.Device).ID)
+							if err != nil {
+								return nil, err
+							}
+						}
+						if e == nil {
+							return nil, nil
+						}
+						return *e, nil
+					},
+				},
+			},
+		},
+	)
 
-	flag.Usage = func() {
-		fmt.Printf("Usage of %s:\n", os.Args[0])
-		fmt.Printf("    [-a event_store_url] [-d device_registry_url] -u username -p password \n")
-	}
-	flag.Parse()
+	var devicePageType = graphql.NewObject(
+		graphql.ObjectConfig{
+			Name: "DevicePage",
+			Fields: graphql.Fields{
+				"totalCount": &graphql.Field{
+					Type: graphql.Int,
+				},
+				"devices": &graphql.Field{
+					Type: graphql.NewList(deviceType),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						devices := p.Source.(api.DevicePage).Devices
+						if selectsField(p, "latestEvent") {
+							return resolveLatestEvents(p.Context, devices, latestEventFetcher, resolveConcurrency)
+						}
+						return devices, nil
+					},
+				},
+			},
+		})
 
-	deviceRegistryClient := api.NewDeviceRegistryClient(deviceRegistryUrl, username, password)
-	eventCache := api.NewEventCache(eventStoreUrl, window)
+	var eventListType = graphql.NewObject(
+		graphql.ObjectConfig{
+			Name: "EventList",
+			Fields: graphql.Fields{
+				"totalCount": &graphql.Field{
+					Type: graphql.Int,
+				},
+				"events": &graphql.Field{
+					Type: graphql.NewList(eventType),
+				},
+			},
+		})
 
-	err := eventCache.Connect(topic, offset)
-	if err != nil {
-		log.Println("Error connecting event cache", err)
-		os.Exit(1)
+	var eventEdgeType = graphql.NewObject(
+		graphql.ObjectConfig{
+			Name: "EventEdge",
+			Fields: graphql.Fields{
+				"cursor": &graphql.Field{
+					Type: graphql.String,
+				},
+				"node": &graphql.Field{
+					Type: eventType,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						e := p.Source.(api.EventEdge)
+						return e.Node, nil
+					},
+				},
+			},
+		})
+
+	var pageInfoType = graphql.NewObject(
+		graphql.ObjectConfig{
+			Name: "PageInfo",
+			Fields: graphql.Fields{
+				"endCursor": &graphql.Field{
+					Type: graphql.String,
+				},
+				"hasNextPage": &graphql.Field{
+					Type: graphql.Boolean,
+				},
+			},
+		})
+
+	var eventConnectionType = graphql.NewObject(
+		graphql.ObjectConfig{
+			Name: "EventConnection",
+			Fields: graphql.Fields{
+				"edges": &graphql.Field{
+					Type: graphql.NewList(eventEdgeType),
+				},
+				"pageInfo": &graphql.Field{
+					Type: pageInfoType,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source, nil
+					},
+				},
+			},
+		})
+
+	var eventStatsType = graphql.NewObject(
+		graphql.ObjectConfig{
+			Name: "EventStats",
+			Fields: graphql.Fields{
+				"count": &graphql.Field{
+					Type: graphql.Int,
+				},
+				"min": &graphql.Field{
+					Type: graphql.Float,
+				},
+				"max": &graphql.Field{
+					Type: graphql.Float,
+				},
+				"avg": &graphql.Field{
+					Type: graphql.Float,
+				},
+				"last": &graphql.Field{
+					Type: graphql.Float,
+				},
+			},
+		})
+
+	var seriesPointType = graphql.NewObject(
+		graphql.ObjectConfig{
+			Name: "SeriesPoint",
+			Fields: graphql.Fields{
+				"time": &graphql.Field{
+					Type: timestampType,
+				},
+				"value": &graphql.Field{
+					Type: graphql.Float,
+				},
+			},
+		})
+
+	var aggregationType = graphql.NewEnum(
+		graphql.EnumConfig{
+			Name: "Aggregation",
+			Values: graphql.EnumValueConfigMap{
+				"AVG":  &graphql.EnumValueConfig{Value: api.AggregateAvg},
+				"LAST": &graphql.EnumValueConfig{Value: api.AggregateLast},
+			},
+		})
+
+	var deviceEventCountType = graphql.NewObject(
+		graphql.ObjectConfig{
+			Name: "DeviceEventCount",
+			Fields: graphql.Fields{
+				"deviceId": &graphql.Field{
+					Type: graphql.String,
+				},
+				"count": &graphql.Field{
+					Type: graphql.Int,
+				},
+			},
+		})
+
+	var cacheInfoType = graphql.NewObject(
+		graphql.ObjectConfig{
+			Name: "CacheInfo",
+			Fields: graphql.Fields{
+				"totalEvents": &graphql.Field{
+					Type: graphql.Int,
+				},
+				"devices": &graphql.Field{
+					Type: graphql.NewList(deviceEventCountType),
+				},
+				"oldest": &graphql.Field{
+					Type: timestampType,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						info := p.Source.(api.CacheInfo)
+						if info.Oldest == nil {
+							return nil, nil
+						}
+						return *info.Oldest, nil
+					},
+				},
+				"newest": &graphql.Field{
+					Type: timestampType,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						info := p.Source.(api.CacheInfo)
+						if info.Newest == nil {
+							return nil, nil
+						}
+						return *info.Newest, nil
+					},
+				},
+			},
+		})
+
+	var auditEntryType = graphql.NewObject(
+		graphql.ObjectConfig{
+			Name: "AuditEntry",
+			Fields: graphql.Fields{
+				"time": &graphql.Field{
+					Type: timestampType,
+				},
+				"deviceId": &graphql.Field{
+					Type: graphql.String,
+				},
+				"previousEnabled": &graphql.Field{
+					Type:        graphql.Boolean,
+					Description: "Enabled state before the change, null if it could not be looked up",
+				},
+				"enabled": &graphql.Field{
+					Type: graphql.Boolean,
+				},
+				"principal": &graphql.Field{
+					Type:        graphql.String,
+					Description: "User that made the change, null if the API is not authenticated",
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return emptyAsNull(p.Source.(api.AuditEntry).Principal), nil
+					},
+				},
+			},
+		})
+
+	var filterOpType = graphql.NewEnum(
+		graphql.EnumConfig{
+			Name: "FilterOp",
+			Values: graphql.EnumValueConfigMap{
+				"EQ":  &graphql.EnumValueConfig{Value: api.OpEQ},
+				"GT":  &graphql.EnumValueConfig{Value: api.OpGT},
+				"LT":  &graphql.EnumValueConfig{Value: api.OpLT},
+				"GTE": &graphql.EnumValueConfig{Value: api.OpGTE},
+				"LTE": &graphql.EnumValueConfig{Value: api.OpLTE},
+			},
+		})
+
+	var sortOrderType = graphql.NewEnum(
+		graphql.EnumConfig{
+			Name: "SortOrder",
+			Values: graphql.EnumValueConfigMap{
+				"ASC":  &graphql.EnumValueConfig{Value: api.Ascending},
+				"DESC": &graphql.EnumValueConfig{Value: api.Descending},
+			},
+		})
+
+	var eventFilterType = graphql.NewInputObject(
+		graphql.InputObjectConfig{
+			Name: "EventFilter",
+			Fields: graphql.InputObjectConfigFieldMap{
+				"field": &graphql.InputObjectFieldConfig{
+					Type: graphql.NewNonNull(graphql.String),
+				},
+				"op": &graphql.InputObjectFieldConfig{
+					Type: graphql.NewNonNull(filterOpType),
+				},
+				"value": &graphql.InputObjectFieldConfig{
+					Type: graphql.String,
+				},
+			},
+		})
+
+	// Arguments for filtering and paging the device list
+	deviceListArgs := func() graphql.FieldConfigArgument {
+		return graphql.FieldConfigArgument{
+			"nameContains": &graphql.ArgumentConfig{
+				Type:         graphql.String,
+				DefaultValue: "",
+			},
+			"hasSensor": &graphql.ArgumentConfig{
+				Type:         graphql.String,
+				DefaultValue: "",
+			},
+			"enabled": &graphql.ArgumentConfig{
+				Type: graphql.Boolean,
+			},
+			"first": &graphql.ArgumentConfig{
+				Type:         graphql.Int,
+				DefaultValue: 0,
+			},
+			"offset": &graphql.ArgumentConfig{
+				Type:         graphql.Int,
+				DefaultValue: 0,
+			},
+		}
+	}
+
+	// Returns the requested page of matching devices and the total number of matches
+	listDevices := func(p graphql.ResolveParams) ([]api.Device, int, error) {
+		devices, err := deviceFetcher(p.Context)
+		if err != nil {
+			return nil, 0, err
+		}
+		devices = api.FilterDevices(devices, deviceFilter(p.Args))
+		return api.PageDevices(devices, p.Args["first"].(int), p.Args["offset"].(int)), len(devices), nil
+	}
+
+	eventListArgs := func() graphql.FieldConfigArgument {
+		return graphql.FieldConfigArgument{
+			"deviceId": &graphql.ArgumentConfig{
+				Type: graphql.String,
+			},
+			"deviceIdPrefix": &graphql.ArgumentConfig{
+				Type:        graphql.String,
+				Description: "Only events of devices with ids starting with this, cannot be combined with deviceId",
+			},
+			"group": &graphql.ArgumentConfig{
+				Type: graphql.String,
+			},
+			"since": &graphql.ArgumentConfig{
+				Type:         timestampType,
+				DefaultValue: int64(0),
+			},
+			"until": &graphql.ArgumentConfig{
+				Type:         timestampType,
+				DefaultValue: int64(0),
+			},
+			"topic": &graphql.ArgumentConfig{
+				Type:         graphql.String,
+				DefaultValue: "",
+			},
+			"max": &graphql.ArgumentConfig{
+				Type:         graphql.Int,
+				DefaultValue: 0,
+			},
+			"filter": &graphql.ArgumentConfig{
+				Type: eventFilterType,
+			},
+			"order": &graphql.ArgumentConfig{
+				Type:         sortOrderType,
+				DefaultValue: api.Ascending,
+			},
+			"compacted": &graphql.ArgumentConfig{
+				Type:         graphql.Boolean,
+				DefaultValue: false,
+			},
+			"includeDisabled": &graphql.ArgumentConfig{
+				Type:         graphql.Boolean,
+				DefaultValue: false,
+				Description:  "Include events from devices that are unknown or disabled in the registry",
+			},
+		}
+	}
+
+	// Returns the event query for the arguments, and the device group to query if given
+	eventListQuery := func(p graphql.ResolveParams) (api.EventQuery, string, error) {
+		query := api.EventQuery{
+			Max:             clampMax(p.Args["max"].(int), maxEventsPerQuery),
+			Since:           p.Args["since"].(int64),
+			Until:           p.Args["until"].(int64),
+			Topic:           p.Args["topic"].(string),
+			Order:           p.Args["order"].(api.SortOrder),
+			Compacted:       p.Args["compacted"].(bool),
+			IncludeDisabled: p.Args["includeDisabled"].(bool),
+		}
+
+		if f, ok := p.Args["filter"].(map[string]interface{}); ok {
+			query.Filter = &api.EventFilter{
+				Field: f["field"].(string),
+				Op:    f["op"].(api.FilterOp),
+			}
+			query.Filter.Value, _ = f["value"].(string)
+		}
+
+		// An omitted deviceId lists events for all devices
+		deviceId, ok := p.Args["deviceId"].(string)
+		if ok && strings.TrimSpace(deviceId) == "" {
+			return query, "", fmt.Errorf("deviceId must not be empty")
+		}
+		prefix, hasPrefix := p.Args["deviceIdPrefix"].(string)
+		if hasPrefix && prefix == "" {
+			return query, "", fmt.Errorf("deviceIdPrefix must not be empty")
+		}
+		if ok && hasPrefix {
+			return query, "", fmt.Errorf("deviceId and deviceIdPrefix cannot be combined")
+		}
+		if group, ok := p.Args["group"].(string); ok {
+			if deviceId != "" {
+				return query, "", fmt.Errorf("deviceId and group cannot be combined")
+			}
+			if hasPrefix {
+				return query, "", fmt.Errorf("deviceIdPrefix and group cannot be combined")
+			}
+			return query, group, nil
+		}
+		if !ok && !hasPrefix && !allowAllDevices {
+			return query, "", fmt.Errorf("deviceId, deviceIdPrefix or group is required, queries for all devices are disabled")
+		}
+		query.DeviceId = deviceId
+		query.DeviceIdPrefix = prefix
+		return query, "", nil
+	}
+
+	var queryType = graphql.NewObject(
+		graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"devices": &graphql.Field{
+					Type: graphql.NewList(deviceType),
+					Args: deviceListArgs(),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						devices, _, err := listDevices(p)
+						if err != nil {
+							return nil, err
+						}
+						if selectsField(p, "latestEvent") {
+							return resolveLatestEvents(p.Context, devices, latestEventFetcher, resolveConcurrency)
+						}
+						return devices, nil
+					},
+				},
+				"devicesPage": &graphql.Field{
+					Type: devicePageType,
+					Args: deviceListArgs(),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						devices, total, err := listDevices(p)
+						if err != nil {
+							return nil, err
+						}
+						return api.DevicePage{
+							TotalCount: total,
+							Devices:    devices,
+						}, nil
+					},
+				},
+				"staleDevices": &graphql.Field{
+					Type: graphql.NewList(deviceType),
+					Args: graphql.FieldConfigArgument{
+						"thresholdSeconds": &graphql.ArgumentConfig{
+							Type: graphql.NewNonNull(graphql.Int),
+						},
+					},
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						if cache == nil {
+							return nil, fmt.Errorf("stale devices are not available in replay mode")
+						}
+						devices, err := deviceFetcher(p.Context)
+						if err != nil {
+							return nil, err
+						}
+						threshold := time.Now().UTC().Unix() - int64(p.Args["thresholdSeconds"].(int))
+						return api.StaleDevices(devices, cache.LastSeen(), threshold), nil
+					},
+				},
+				"device": &graphql.Field{
+					Type: deviceType,
+					Args: graphql.FieldConfigArgument{
+						"id": &graphql.ArgumentConfig{
+							Type: graphql.NewNonNull(graphql.String),
+						},
+					},
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						device, err := deviceGetter(p.Context, p.Args["id"].(string))
+						if err != nil || device == nil {
+							return nil, err
+						}
+						return *device, nil
+					},
+				},
+				"events": &graphql.Field{
+					Type: graphql.NewList(eventType),
+					Args: eventListArgs(),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						query, group, err := eventListQuery(p)
+						if err != nil {
+							return nil, err
+						}
+						if group != "" {
+							return groupEvents(p.Context, deviceFetcher, eventFetcher, group, query)
+						}
+						return tracedListEvents(p.Context, eventFetcher, query)
+					},
+				},
+				"latestEvents": &graphql.Field{
+					Type:        graphql.NewList(eventType),
+					Description: "The newest event of each device, of all devices with events if deviceIds is empty",
+					Args: graphql.FieldConfigArgument{
+						"deviceIds": &graphql.ArgumentConfig{
+							Type: graphql.NewList(graphql.NewNonNull(graphql.String)),
+						},
+					},
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						var ids []string
+						if list, ok := p.Args["deviceIds"].([]interface{}); ok {
+							for _, id := range list {
+								ids = append(ids, id.(string))
+							}
+						}
+						if len(ids) == 0 && !allowAllDevices {
+							return nil, fmt.Errorf("deviceIds is required, queries for all devices are disabled")
+						}
+						return events.LatestPerDevice(ids)
+					},
+				},
+				"eventList": &graphql.Field{
+					Type: eventListType,
+					Args: eventListArgs(),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						query, group, err := eventListQuery(p)
+						if err != nil {
+							return nil, err
+						}
+						if group != "" {
+							return groupEventList(p.Context, deviceFetcher, eventLister, group, query)
+						}
+						var list api.EventList
+						err = traceListEvents(p.Context, query, func() (err error) {
+							list, err = eventLister(query)
+							return err
+						})
+						return list, err
+					},
+				},
+				"eventStats": &graphql.Field{
+					Type: eventStatsType,
+					Args: graphql.FieldConfigArgument{
+						"deviceId": &graphql.ArgumentConfig{
+							Type: graphql.NewNonNull(graphql.String),
+						},
+						"field": &graphql.ArgumentConfig{
+							Type: graphql.NewNonNull(graphql.String),
+						},
+						"since": &graphql.ArgumentConfig{
+							Type:         timestampType,
+							DefaultValue: int64(0),
+						},
+						"until": &graphql.ArgumentConfig{
+							Type:         timestampType,
+							DefaultValue: int64(0),
+						},
+					},
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						deviceId := p.Args["deviceId"].(string)
+						field := p.Args["field"].(string)
+						since := p.Args["since"].(int64)
+						until := p.Args["until"].(int64)
+						return events.EventStats(deviceId, field, since, until)
+					},
+				},
+				"eventSeries": &graphql.Field{
+					Type: graphql.NewList(seriesPointType),
+					Args: graphql.FieldConfigArgument{
+						"deviceId": &graphql.ArgumentConfig{
+							Type: graphql.NewNonNull(graphql.String),
+						},
+						"field": &graphql.ArgumentConfig{
+							Type: graphql.NewNonNull(graphql.String),
+						},
+						"since": &graphql.ArgumentConfig{
+							Type: graphql.NewNonNull(timestampType),
+						},
+						"until": &graphql.ArgumentConfig{
+							Type:         timestampType,
+							DefaultValue: int64(0),
+						},
+						"bucketSeconds": &graphql.ArgumentConfig{
+							Type: graphql.NewNonNull(graphql.Int),
+						},
+						"aggregation": &graphql.ArgumentConfig{
+							Type:         aggregationType,
+							DefaultValue: api.AggregateAvg,
+						},
+						"includeEmpty": &graphql.ArgumentConfig{
+							Type:         graphql.Boolean,
+							DefaultValue: false,
+						},
+					},
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return events.EventSeries(api.SeriesQuery{
+							DeviceId:      p.Args["deviceId"].(string),
+							Field:         p.Args["field"].(string),
+							Since:         p.Args["since"].(int64),
+							Until:         p.Args["until"].(int64),
+							BucketSeconds: int64(p.Args["bucketSeconds"].(int)),
+							Aggregation:   p.Args["aggregation"].(api.Aggregation),
+							IncludeEmpty:  p.Args["includeEmpty"].(bool),
+						})
+					},
+				},
+				"cacheInfo": &graphql.Field{
+					Type: cacheInfoType,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						if cache == nil {
+							return nil, fmt.Errorf("cache information is not available in replay mode")
+						}
+						return cache.Stats(), nil
+					},
+				},
+				"auditLog": &graphql.Field{
+					Type:        graphql.NewList(auditEntryType),
+					Description: "Changes of the enabled state of devices made through the API, oldest first",
+					Args: graphql.FieldConfigArgument{
+						"deviceId": &graphql.ArgumentConfig{
+							Type:         graphql.String,
+							DefaultValue: "",
+						},
+					},
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return auditLister(p.Args["deviceId"].(string)), nil
+					},
+				},
+				"eventsConnection": &graphql.Field{
+					Type: eventConnectionType,
+					Args: graphql.FieldConfigArgument{
+						"deviceId": &graphql.ArgumentConfig{
+							Type:         graphql.String,
+							DefaultValue: "",
+						},
+						"after": &graphql.ArgumentConfig{
+							Type:         graphql.String,
+							DefaultValue: "",
+						},
+						"max": &graphql.ArgumentConfig{
+							Type:         graphql.Int,
+							DefaultValue: 0,
+						},
+					},
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						deviceId := p.Args["deviceId"].(string)
+						if deviceId == "" && !allowAllDevices {
+							return nil, fmt.Errorf("deviceId is required, queries for all devices are disabled")
+						}
+						after := p.Args["after"].(string)
+						max := clampMax(p.Args["max"].(int), maxEventsPerQuery)
+						return events.ListEventsPaged(deviceId, after, max)
+					},
+				},
+			},
+		})
+
+	var mutationType = graphql.NewObject(
+		graphql.ObjectConfig{
+			Name: "Mutation",
+			Fields: graphql.Fields{
+				"setDeviceEnabled": &graphql.Field{
+					Type: deviceType,
+					Args: graphql.FieldConfigArgument{
+						"deviceId": &graphql.ArgumentConfig{
+							Type: graphql.NewNonNull(graphql.String),
+						},
+						"enabled": &graphql.ArgumentConfig{
+							Type: graphql.NewNonNull(graphql.Boolean),
+						},
+					},
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						deviceId := p.Args["deviceId"].(string)
+						enabled := p.Args["enabled"].(bool)
+						return deviceEnabler(p.Context, deviceId, enabled)
+					},
+				},
+				"updateDevice": &graphql.Field{
+					Type: deviceType,
+					Args: graphql.FieldConfigArgument{
+						"deviceId": &graphql.ArgumentConfig{
+							Type: graphql.NewNonNull(graphql.String),
+						},
+						"name": &graphql.ArgumentConfig{
+							Type: graphql.String,
+						},
+						"description": &graphql.ArgumentConfig{
+							Type: graphql.String,
+						},
+					},
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						deviceId := p.Args["deviceId"].(string)
+						var patch api.DevicePatch
+						if name, ok := p.Args["name"].(string); ok {
+							if strings.TrimSpace(name) == "" {
+								return nil, fmt.Errorf("name must not be empty")
+							}
+							patch.Name = &name
+						}
+						if description, ok := p.Args["description"].(string); ok {
+							patch.Description = &description
+						}
+						if patch.Name == nil && patch.Description == nil {
+							return nil, fmt.Errorf("name or description must be given")
+						}
+						return deviceUpdater(p.Context, deviceId, patch)
+					},
+				},
+			},
+		})
+
+	// Only allow injecting events when explicitly enabled
+	if eventPublisher != nil {
+		mutationType.AddFieldConfig("publishEvent", &graphql.Field{
+			Type: eventType,
+			Args: graphql.FieldConfigArgument{
+				"deviceId": &graphql.ArgumentConfig{
+					Type: graphql.NewNonNull(graphql.String),
+				},
+				"data": &graphql.ArgumentConfig{
+					Type: graphql.NewNonNull(jsonType),
+				},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				if cache == nil {
+					return nil, fmt.Errorf("publishing events is not available in replay mode")
+				}
+				data, ok := p.Args["data"].(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("data must be a JSON object")
+				}
+				event := api.Event{
+					DeviceId:     p.Args["deviceId"].(string),
+					CreationTime: time.Now().UTC().Unix(),
+					Data:         data,
+				}
+				eventPublisher(event)
+				return event, nil
+			},
+		})
 	}
-	done := make(chan error)
-	go eventCache.Run(done)
-
-	schema := createSchema(deviceRegistryClient.ListDevices, eventCache.ListEvents)
-	http.HandleFunc("/graphql",
-		func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept")
-			if r.Method == "POST" {
-				body, err := ioutil.ReadAll(r.Body)
+
+	var schema, _ = graphql.NewSchema(
+		graphql.SchemaConfig{
+			Query:    queryType,
+			Mutation: mutationType,
+		},
+	)
+	return schema
+}
+
+// Parse, validate and execute a query, returning the result and the HTTP status to respond with.
+// Mutations are rejected unless allowMutations is set, as they must not be sent using GET.
+func executeQuery(ctx context.Context, request queryBody, schema graphql.Schema, maxDepth int, allowMutations bool) (*graphql.Result, int) {
+	doc, err := parser.Parse(parser.ParseParams{
+		Source: source.NewSource(&source.Source{
+			Body: []byte(request.Query),
+			Name: "GraphQL request",
+		}),
+	})
+	if err != nil {
+		result := &graphql.Result{Errors: gqlerrors.FormatErrors(err)}
+		log.Printf("wrong result, unexpected errors: %v", result.Errors)
+		return result, http.StatusBadRequest
+	}
+
+	rules := append([]graphql.ValidationRuleFn{}, graphql.SpecifiedRules...)
+	if maxDepth > 0 {
+		rules = append(rules, maxDepthRule(maxDepth))
+	}
+	validation := graphql.ValidateDocument(&schema, doc, rules)
+	if !validation.IsValid {
+		result := &graphql.Result{Errors: validation.Errors}
+		log.Printf("wrong result, unexpected errors: %v", result.Errors)
+		return result, http.StatusBadRequest
+	}
+
+	if !allowMutations {
+		for _, definition := range doc.Definitions {
+			op, ok := definition.(*ast.OperationDefinition)
+			if !ok || (request.OperationName != "" && (op.Name == nil || op.Name.Value != request.OperationName)) {
+				continue
+			}
+			if op.Operation == ast.OperationTypeMutation {
+				result := &graphql.Result{Errors: gqlerrors.FormatErrors(fmt.Errorf("Mutations must be sent using POST"))}
+				return result, http.StatusMethodNotAllowed
+			}
+		}
+	}
+
+	if request.ValidateOnly {
+		return &graphql.Result{}, http.StatusOK
+	}
+
+	result := graphql.Execute(graphql.ExecuteParams{
+		Schema:        schema,
+		AST:           doc,
+		Args:          request.Variables,
+		OperationName: request.OperationName,
+		Context:       ctx,
+	})
+	if len(result.Errors) > 0 {
+		log.Printf("wrong result, unexpected errors: %v", result.Errors)
+	}
+	return result, http.StatusOK
+}
+
+// Write a result, or a list of results for a batched request, as JSON
+func writeResult(w http.ResponseWriter, result interface{}, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	if status == http.StatusMethodNotAllowed {
+		w.Header().Set("Allow", "POST")
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+// Returns true if the request asks for validation only, using the validateOnly parameter or the X-Validate-Only header
+func validateOnly(r *http.Request) bool {
+	value := r.URL.Query().Get("validateOnly")
+	if value == "" {
+		value = r.Header.Get("X-Validate-Only")
+	}
+	validate, _ := strconv.ParseBool(value)
+	return validate
+}
+
+// Media types accepted for GraphQL POST requests
+const (
+	jsonMediaType    = "application/json"
+	graphqlMediaType = "application/graphql"
+)
+
+// Returns the media type of a POST request. Unless strict, types other than application/graphql are
+// treated as JSON, so that clients which do not set the content type keep working.
+func postMediaType(r *http.Request, strict bool) (string, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err == nil && (mediaType == jsonMediaType || mediaType == graphqlMediaType) {
+		return mediaType, nil
+	}
+	if !strict {
+		return jsonMediaType, nil
+	}
+	if r.Header.Get("Content-Type") == "" {
+		return "", fmt.Errorf("missing Content-Type, expected %s or %s", jsonMediaType, graphqlMediaType)
+	}
+	return "", fmt.Errorf("unsupported Content-Type %q, expected %s or %s", r.Header.Get("Content-Type"), jsonMediaType, graphqlMediaType)
+}
+
+// Returns the query, operation name and variables given as URL parameters
+func paramsQueryBody(r *http.Request) (queryBody, error) {
+	params := r.URL.Query()
+	data := queryBody{
+		Query:         params.Get("query"),
+		OperationName: params.Get("operationName"),
+		ValidateOnly:  validateOnly(r),
+	}
+	if variables := params.Get("variables"); variables != "" {
+		err := json.Unmarshal([]byte(variables), &data.Variables)
+		if err != nil {
+			return data, fmt.Errorf("invalid variables parameter: %v", err)
+		}
+	}
+	return data, nil
+}
+
+func graphqlHandler(schema graphql.Schema, maxQueryBytes int64, maxDepth int, strictContentType bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			if strings.Contains(r.Header.Get("Accept"), "text/html") {
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				fmt.Fprint(w, playgroundPage)
+				return
+			}
+			data, err := paramsQueryBody(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if data.Query == "" {
+				http.Error(w, "missing query parameter", http.StatusBadRequest)
+				return
+			}
+			result, status := executeQuery(r.Context(), data, schema, maxDepth, false)
+			writeResult(w, result, status)
+		} else if r.Method == "POST" {
+			mediaType, err := postMediaType(r, strictContentType)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, maxQueryBytes)
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			// The whole body of an application/graphql request is the query, the operation name and
+			// variables may be given as URL parameters
+			if mediaType == graphqlMediaType {
+				data, err := paramsQueryBody(r)
 				if err != nil {
 					http.Error(w, err.Error(), http.StatusBadRequest)
 					return
 				}
-				var data queryBody
-				err = json.Unmarshal(body, &data)
+				data.Query = string(body)
+				result, status := executeQuery(r.Context(), data, schema, maxDepth, true)
+				writeResult(w, result, status)
+				return
+			}
+			// A JSON array is a batch of queries, answered with an array of results in the same order
+			trimmed := bytes.TrimSpace(body)
+			if len(trimmed) > 0 && trimmed[0] == '[' {
+				var batch []queryBody
+				err = json.Unmarshal(trimmed, &batch)
 				if err != nil {
 					http.Error(w, err.Error(), http.StatusBadRequest)
 					return
 				}
-				result := executeQuery(data.Query, schema)
-				json.NewEncoder(w).Encode(result)
+				results := make([]*graphql.Result, 0, len(batch))
+				for _, data := range batch {
+					data.ValidateOnly = validateOnly(r)
+					result, _ := executeQuery(r.Context(), data, schema, maxDepth, true)
+					results = append(results, result)
+				}
+				writeResult(w, results, http.StatusOK)
+				return
+			}
+			var data queryBody
+			err = json.Unmarshal(body, &data)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			data.ValidateOnly = validateOnly(r)
+			result, status := executeQuery(r.Context(), data, schema, maxDepth, true)
+			writeResult(w, result, status)
+		}
+	}
+}
+
+type healthStatus struct {
+	Status         string `json:"status"`
+	EventStore     string `json:"eventStore,omitempty"`
+	DeviceRegistry string `json:"deviceRegistry,omitempty"`
+}
+
+func writeHealth(w http.ResponseWriter, status healthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	if status.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, healthStatus{Status: "ok"})
+}
+
+// Wrap a check to reuse its result for ttl, so that frequent probes do not each reach the
+// checked service. Concurrent callers wait for the check in progress instead of starting another.
+func cachedCheck(check func(context.Context) error, ttl time.Duration) func(context.Context) error {
+	var mutex sync.Mutex
+	var checked time.Time
+	var result error
+	return func(ctx context.Context) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !checked.IsZero() && time.Since(checked) < ttl {
+			return result
+		}
+		err := check(ctx)
+		// A check cut short by the caller says nothing about the service
+		if ctx.Err() == nil {
+			checked, result = time.Now(), err
+		}
+		return err
+	}
+}
+
+// Serve readiness, which requires a connected event store. The registry is checked with
+// registryPing if set, and only affects readiness when registryRequired is set.
+func readinessHandler(eventStoreState func() api.ConnectionState, registryPing func(context.Context) error, registryRequired bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := healthStatus{Status: "ok"}
+		state := eventStoreState()
+		status.EventStore = string(state)
+		if state != api.Connected {
+			status.Status = "unavailable"
+		}
+		if registryPing != nil {
+			err := registryPing(r.Context())
+			if err != nil {
+				if registryRequired {
+					status.Status = "unavailable"
+				}
+				status.DeviceRegistry = err.Error()
+			} else {
+				status.DeviceRegistry = "ok"
+			}
+		}
+		writeHealth(w, status)
+	}
+}
+
+// Parse a comma-separated list of [name=]url device registries. Credentials in a URL take precedence
+// over the given username and password, and the name defaults to the host of the URL.
+func parseDeviceRegistries(value string, username string, password string) []api.DeviceRegistryConfig {
+	entries := splitList(value)
+	if len(entries) == 0 {
+		return []api.DeviceRegistryConfig{{Username: username, Password: password}}
+	}
+	var configs []api.DeviceRegistryConfig
+	for _, entry := range entries {
+		config := api.DeviceRegistryConfig{Url: entry, Username: username, Password: password}
+		if eq := strings.Index(entry, "="); eq >= 0 && !strings.Contains(entry[:eq], "/") {
+			config.Source = entry[:eq]
+			config.Url = entry[eq+1:]
+		}
+		if u, err := url.Parse(config.Url); err == nil {
+			if config.Source == "" {
+				config.Source = u.Host
+			}
+			if u.User != nil {
+				config.Username = u.User.Username()
+				config.Password, _ = u.User.Password()
+				u.User = nil
+				config.Url = u.String()
+			}
+		}
+		configs = append(configs, config)
+	}
+	return configs
+}
+
+// Call connect until it succeeds or the timeout has passed, backing off between attempts
+func connectWithRetry(connect func() error, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	backoff := time.Second
+	for {
+		err := connect()
+		if err == nil {
+			return nil
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return err
+		}
+		if backoff > remaining {
+			backoff = remaining
+		}
+		log.Printf("Error connecting to event store, retrying in %v: %v", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+// Returns the base path with a leading slash and without a trailing slash, or "" for the root
+func normalizeBasePath(basePath string) string {
+	basePath = strings.Trim(strings.TrimSpace(basePath), "/")
+	if basePath == "" {
+		return ""
+	}
+	return "/" + basePath
+}
+
+// Split a comma-separated flag value, ignoring empty entries
+func splitList(value string) []string {
+	var ret []string
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry != "" {
+			ret = append(ret, entry)
+		}
+	}
+	return ret
+}
+
+func createTLSConfig(caCertFile string, certFile string, keyFile string, serverName string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: insecure,
+	}
+	if caCertFile != "" {
+		caCert, err := ioutil.ReadFile(caCertFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in %s", caCertFile)
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// TLS configuration for serving HTTPS. HTTP/2 is negotiated by the server.
+func createServerTLSConfig(certFile string, keyFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("-tls-cert and -tls-key must be given together")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// Default to a container id that is unique per process, so that replicas do not steal each others links
+func defaultContainerId() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("dings-api-%s-%d", hostname, os.Getpid())
+}
+
+func main() {
+	var cfg config
+	cfg.registerFlags(flag.CommandLine)
+
+	flag.Usage = func() {
+		fmt.Printf("Usage of %s:\n", os.Args[0])
+		fmt.Printf("    [-a event_store_url] [-d device_registry_url] [-l listen_addr] -u username -p password \n")
+	}
+	flag.Parse()
+
+	err := applyEnvironment(flag.CommandLine, flagEnvironment)
+	if err != nil {
+		log.Println("Error reading configuration from environment:", err)
+		os.Exit(1)
+	}
+
+	if cfg.PrintConfig {
+		log.Printf("Configuration:\n%s", cfg)
+	}
+
+	_, err = net.ResolveTCPAddr("tcp", cfg.ListenAddr)
+	if err != nil {
+		log.Printf("Invalid listen address %s: %v", cfg.ListenAddr, err)
+		os.Exit(1)
+	}
+
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		log.Println("Error setting up tracing:", err)
+		os.Exit(1)
+	}
+
+	eventStoreOptions := api.EventStoreOptions{
+		Username:        cfg.EventStoreUser,
+		Password:        cfg.EventStorePass,
+		ContainerId:     cfg.ContainerId,
+		Prefetch:        cfg.Prefetch,
+		MaxMessageBytes: cfg.MaxMessageBytes,
+		Heartbeat:       cfg.Heartbeat,
+		ReceiveTimeout:  cfg.ReceiveTimeout,
+		CompactRepeats:  cfg.CompactRepeats,
+		PruneAlign:      cfg.PruneAlign,
+		MetaProperties:  splitList(cfg.MetaProperties),
+	}
+	if cfg.FieldAliasesFile != "" {
+		eventStoreOptions.FieldAliases, err = api.LoadFieldAliases(cfg.FieldAliasesFile)
+		if err != nil {
+			log.Println("Error loading field aliases:", err)
+			os.Exit(1)
+		}
+	}
+	if cfg.RateLimit > 0 && cfg.RateBurst < 1 {
+		log.Println("Error: -rate-burst must be at least 1 with -rate-limit")
+		os.Exit(1)
+	}
+	if cfg.ApiUser == "" && cfg.ApiPass != "" {
+		log.Println("Error: -api-pass requires -api-user")
+		os.Exit(1)
+	}
+	if cfg.AuditHistory < 0 {
+		log.Println("Error: -audit-history must not be negative")
+		os.Exit(1)
+	}
+	if cfg.FilterDisabled && cfg.DeviceRegistryUrl == "" {
+		log.Println("Error: -filter-disabled requires -d")
+		os.Exit(1)
+	}
+	if cfg.ApiToken == "" && cfg.ApiUser == "" {
+		log.Println("Warning: the GraphQL endpoint is not authenticated, consider setting -api-token or -api-user")
+	}
+
+	if cfg.EventStoreUser != "" && !cfg.EventStoreTLS {
+		log.Println("Warning: sending event store credentials over an unencrypted connection, consider enabling -a-tls")
+	}
+	if cfg.EventStoreTLS {
+		eventStoreOptions.TLSConfig, err = createTLSConfig(cfg.EventStoreCACert, cfg.EventStoreCert, cfg.EventStoreKey, cfg.EventStoreServerName, cfg.EventStoreInsecure)
+		if err != nil {
+			log.Println("Error configuring event store TLS", err)
+			os.Exit(1)
+		}
+	}
+
+	registries, err := api.NewFederatedRegistry(parseDeviceRegistries(cfg.DeviceRegistryUrl, cfg.Username, cfg.Password), api.DeviceRegistryOptions{
+		Timeout:             cfg.DeviceTimeout,
+		MaxIdleConnsPerHost: cfg.DeviceMaxIdleConns,
+		IdleConnTimeout:     cfg.DeviceIdleTimeout,
+		DisableKeepAlives:   !cfg.DeviceKeepAlives,
+	})
+	if err != nil {
+		log.Println("Error configuring device registries:", err)
+		os.Exit(1)
+	}
+	var deviceSource api.DeviceSource = registries
+	if cfg.Replay && cfg.DbUrl != "" {
+		log.Println("Error: -replay and -db-url cannot be combined")
+		os.Exit(1)
+	}
+	if cfg.DbRetention < 0 {
+		log.Println("Error: -db-retention must not be negative")
+		os.Exit(1)
+	}
+	var eventDB api.EventStore
+	var eventDBPing func(context.Context) error
+	var runRetention func(context.Context, time.Duration)
+	closeEventDB := func() error { return nil }
+	if cfg.DbUrl != "" {
+		db, err := api.NewDBEventStore(cfg.DbUrl)
+		if err != nil {
+			log.Println("Error opening event database:", err)
+			os.Exit(1)
+		}
+		eventStoreOptions.Persist = db.Add
+		eventDB, closeEventDB = db, db.Close
+		eventDBPing = cachedCheck(db.Ping, cfg.ReadyDbCache)
+		runRetention = db.RunRetention
+	}
+	cacheFile := cfg.CacheFile
+	if cfg.Replay {
+		cacheFile = ""
+	}
+	eventCache := api.NewEventCache(cfg.EventStoreUrl, cfg.Window, cfg.MaxEvents, cacheFile, eventStoreOptions)
+	var eventStore api.EventStore = eventCache
+	var cacheInspector api.CacheInspector = eventCache
+	eventStoreState := eventCache.State
+	if eventDB != nil {
+		// Events are received into the cache and written to the database, queries read the database
+		eventStore = eventDB
+		eventStoreState = func() api.ConnectionState {
+			if state := eventCache.State(); state != api.Connected {
+				return state
+			}
+			if eventDBPing(context.Background()) != nil {
+				return api.Disconnected
+			}
+			return api.Connected
+		}
+	}
+	done := make(chan error)
+
+	if cfg.Replay {
+		// The cache stays empty, events are read from the event store for each query
+		replay := api.NewReplayEventStore(cfg.EventStoreUrl, splitList(cfg.Topic), cfg.Window, cfg.ReplayIdle, eventStoreOptions)
+		err = connectWithRetry(replay.Check, cfg.ConnectTimeout)
+		if err != nil {
+			log.Println("Error connecting to event store", err)
+			os.Exit(1)
+		}
+		log.Printf("Replaying events from event store %s for each query", cfg.EventStoreUrl)
+		eventStore = replay
+		eventStoreState = replay.State
+		cacheInspector = nil
+	} else {
+		// Resume from the offsets in the cache snapshot unless told otherwise
+		offsetSet := false
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "o" {
+				offsetSet = true
 			}
 		})
+		position, err := api.ParseStartPosition(cfg.Offset, time.Now().UTC().Unix())
+		if err != nil {
+			log.Println("Invalid -o:", err)
+			os.Exit(1)
+		}
+		err = connectWithRetry(func() error {
+			if offsetSet {
+				return eventCache.Connect(splitList(cfg.Topic), position)
+			}
+			return eventCache.Resume(splitList(cfg.Topic), position.Offset)
+		}, cfg.ConnectTimeout)
+		if err != nil {
+			log.Println("Error connecting event cache", err)
+			os.Exit(1)
+		}
+		go eventCache.Run(done)
+	}
 
-	go func() {
-		err := http.ListenAndServe(":8080", nil)
+	pruneCtx, stopPruning := context.WithCancel(context.Background())
+	if !cfg.Replay {
+		go eventCache.RunPruning(pruneCtx, cfg.PruneInterval)
+	}
+
+	// Cancelled when shutdown starts, so that streaming responses and background pollers finish.
+	// Other requests keep their own context, and finish within the shutdown timeout.
+	shutdownCtx, startShutdown := context.WithCancel(context.Background())
+	if !cfg.Replay {
+		go eventCache.RunSnapshots(shutdownCtx, cfg.SnapshotInterval)
+	}
+	if runRetention != nil && cfg.DbRetention > 0 {
+		go runRetention(shutdownCtx, cfg.DbRetention)
+	}
+
+	var eventPublisher eventPublisherFunc
+	if cfg.AllowPublish {
+		eventPublisher = eventCache.Add
+	}
+	queryStore := eventStore
+	if cfg.FilterDisabled {
+		enabledDevices := api.NewEnabledDevices(deviceSource.ListDevices, cfg.EnabledRefresh)
+		go enabledDevices.Run(shutdownCtx)
+		queryStore = enabledDevices.RestrictStore(eventStore)
+	}
+	auditLog := api.NewAuditLog(cfg.AuditHistory)
+	deviceEnabler := auditedEnabler(deviceSource.GetDevice, deviceSource.SetEnabled, auditLog.Add)
+	schema := createSchema(deviceSource.ListDevices, deviceSource.GetDevice, queryStore, cacheInspector, deviceEnabler, deviceSource.Update, eventPublisher, auditLog.List, cfg.ComputeHeatIndex, cfg.ResolveConcurrency, cfg.MaxEventsPerQuery, cfg.AllowAllDevices)
+	basePath := normalizeBasePath(cfg.BasePath)
+	mux := http.NewServeMux()
+	var queryHandler http.Handler = graphqlHandler(schema, cfg.MaxQueryBytes, cfg.MaxQueryDepth, cfg.StrictContentType)
+	if cfg.MaxConcurrentQueries > 0 {
+		queryHandler = concurrencyLimitHandler(cfg.MaxConcurrentQueries, queryHandler)
+	}
+	if cfg.ForwardAuth {
+		queryHandler = registryAuthHandler(queryHandler)
+	}
+	mux.Handle(basePath+"/graphql", corsHandler(splitList(cfg.CorsOrigins), authHandler(cfg.ApiToken, cfg.ApiUser, cfg.ApiPass, queryHandler)))
+	var deviceListHandler http.Handler = devicesHandler(deviceSource.ListDevices)
+	if cfg.ForwardAuth {
+		deviceListHandler = registryAuthHandler(deviceListHandler)
+	}
+	mux.Handle(basePath+"/devices", corsHandler(splitList(cfg.CorsOrigins), authHandler(cfg.ApiToken, cfg.ApiUser, cfg.ApiPass, deviceListHandler)))
+	mux.Handle(basePath+"/schema", corsHandler(splitList(cfg.CorsOrigins), authHandler(cfg.ApiToken, cfg.ApiUser, cfg.ApiPass, schemaHandler(schema))))
+
+	err = api.RegisterMetrics(prometheus.DefaultRegisterer)
+	if err == nil {
+		err = prometheus.DefaultRegisterer.Register(queriesRejected)
+	}
+	if err == nil {
+		err = prometheus.DefaultRegisterer.Register(requestsThrottled)
+	}
+	if err != nil {
+		log.Println("Error registering metrics", err)
+		os.Exit(1)
+	}
+	mux.Handle(basePath+"/metrics", promhttp.Handler())
+
+	mux.HandleFunc(basePath+"/healthz", healthHandler)
+	var registryCheck func(context.Context) error
+	if cfg.DeviceRegistryUrl != "" {
+		registryCheck = cachedCheck(deviceSource.Ping, cfg.ReadyRegistryCache)
+	}
+	mux.HandleFunc(basePath+"/readyz", readinessHandler(eventStoreState, registryCheck, cfg.ReadyRegistry))
+
+	// Admin endpoints are only served when the API requires authentication
+	if cfg.ApiToken != "" || cfg.ApiUser != "" {
+		// The cache is not connected in replay mode, so there is no window or rejected messages
+		if !cfg.Replay {
+			mux.Handle(basePath+"/admin/window", authHandler(cfg.ApiToken, cfg.ApiUser, cfg.ApiPass, windowHandler(eventCache.Window, eventCache.SetWindow)))
+			mux.Handle(basePath+"/admin/rejected", authHandler(cfg.ApiToken, cfg.ApiUser, cfg.ApiPass, rejectedHandler(eventCache.Rejected)))
+		}
+		readTopic := func(topic string, offset int64, max int) ([]api.Event, error) {
+			return api.ReadTopic(cfg.EventStoreUrl, topic, offset, max, cfg.ReplayIdle, eventStoreOptions)
+		}
+		mux.Handle(basePath+"/admin/replay", authHandler(cfg.ApiToken, cfg.ApiUser, cfg.ApiPass, replayHandler(splitList(cfg.Topic), readTopic, cfg.MaxEventsPerQuery)))
+	}
+	mux.Handle(basePath+"/export/events", corsHandler(splitList(cfg.CorsOrigins), authHandler(cfg.ApiToken, cfg.ApiUser, cfg.ApiPass, exportHandler(queryStore.StreamEvents, cfg.AllowAllDevices))))
+	if !cfg.Replay {
+		mux.Handle(basePath+"/events/stream", corsHandler(splitList(cfg.CorsOrigins), authHandler(cfg.ApiToken, cfg.ApiUser, cfg.ApiPass, eventStreamHandler(eventCache.Subscribe, cfg.StreamHeartbeat, cfg.StreamWriteTimeout, shutdownCtx.Done()))))
+	}
+	if cfg.DeviceRegistryUrl != "" && cfg.DevicePollInterval > 0 {
+		watcher := api.NewDeviceWatcher(deviceSource.ListDevices, cfg.DevicePollInterval)
+		go watcher.Run(shutdownCtx)
+		mux.Handle(basePath+"/devices/stream", corsHandler(splitList(cfg.CorsOrigins), authHandler(cfg.ApiToken, cfg.ApiUser, cfg.ApiPass, deviceStreamHandler(watcher.Subscribe, cfg.StreamHeartbeat, cfg.StreamWriteTimeout, shutdownCtx.Done()))))
+	}
+
+	var handler http.Handler = mux
+	if cfg.RateLimit > 0 {
+		limiter := newClientLimiter(cfg.RateLimit, cfg.RateBurst, cfg.TrustProxy)
+		go limiter.Run(shutdownCtx)
+		// Probes and metrics scrapes are not limited, so a busy client can not fail them
+		handler = limiter.handler(handler, basePath+"/healthz", basePath+"/readyz", basePath+"/metrics")
+	}
+	if cfg.AccessLog {
+		handler = accessLogHandler(handler)
+	}
+	handler = tracingHandler(handler)
+	server := &http.Server{
+		Addr:    cfg.ListenAddr,
+		Handler: handler,
+	}
+	if cfg.TLSCert != "" || cfg.TLSKey != "" {
+		// Load the certificate up front, so that a bad certificate fails at startup
+		server.TLSConfig, err = createServerTLSConfig(cfg.TLSCert, cfg.TLSKey)
 		if err != nil {
+			log.Println("Error loading HTTPS certificate:", err)
+			os.Exit(1)
+		}
+	}
+	server.RegisterOnShutdown(startShutdown)
+	go func() {
+		var err error
+		if server.TLSConfig != nil {
+			log.Printf("Listening for HTTPS requests on %s%s", cfg.ListenAddr, basePath)
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			log.Printf("Listening for HTTP requests on %s%s", cfg.ListenAddr, basePath)
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			done <- err
 		}
-		log.Println("Now server is running on port 8080")
 	}()
 
-	// Exit if any of our processes complete
-	for {
-		err := <-done
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	// Exit if any of our processes complete or we are asked to stop
+	select {
+	case sig := <-signals:
+		log.Printf("Received %v, shutting down", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		err := server.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			log.Println("Error shutting down HTTP server", err)
+		}
+		stopPruning()
+		eventCache.Close()
+		closeEventDB()
+		ctx, cancel = context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		err = shutdownTracing(ctx)
+		cancel()
+		if err != nil {
+			log.Println("Error flushing traces", err)
+		}
+		err = eventCache.Snapshot()
+		if err != nil {
+			log.Println("Error writing event cache snapshot", err)
+		}
+		log.Println("Finished without error")
+		os.Exit(0)
+	case err := <-done:
+		snapshotErr := eventCache.Snapshot()
+		if snapshotErr != nil {
+			log.Println("Error writing event cache snapshot", snapshotErr)
+		}
 		if err != nil {
 			log.Println("Finished with error", err)
 			os.Exit(1)
@@ -0,0 +1,385 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/graphql-go/graphql"
+	"github.com/lulf/dings-api/pkg/api"
+)
+
+var testDevices = []api.Device{
+	{ID: "dev1", Enabled: true, Name: "Greenhouse", Sensors: []string{"temperature"}},
+	{ID: "dev2", Name: "Shed"},
+}
+
+var testEvents = []api.Event{
+	{DeviceId: "dev1", CreationTime: 100, Data: map[string]interface{}{
+		"temperature": map[string]interface{}{"celcius": 21.5, "humidity": 40.0},
+		"motion":      true,
+	}},
+	{DeviceId: "dev2", CreationTime: 200, Data: map[string]interface{}{
+		"motion": false,
+	}},
+}
+
+// Schema served by stub fetchers and an event store returning fixed devices and events. The event
+// queries received by the store are recorded.
+type schemaFixture struct {
+	devices []api.Device
+	events  []api.Event
+	queries []api.EventQuery
+
+	computeHeatIndex bool
+}
+
+func newSchemaFixture() *schemaFixture {
+	return &schemaFixture{devices: testDevices, events: testEvents}
+}
+
+func (f *schemaFixture) listDevices(ctx context.Context) ([]api.Device, error) {
+	return f.devices, nil
+}
+
+func (f *schemaFixture) getDevice(ctx context.Context, id string) (*api.Device, error) {
+	for _, device := range f.devices {
+		if device.ID == id {
+			return &device, nil
+		}
+	}
+	return nil, nil
+}
+
+// Returns the events of the queried device, or all events if no device is given. Queries are
+// validated as by the event stores.
+func (f *schemaFixture) ListEvents(query api.EventQuery) ([]api.Event, error) {
+	f.queries = append(f.queries, query)
+	if err := query.Validate(); err != nil {
+		return nil, err
+	}
+	events := make([]api.Event, 0)
+	for _, e := range f.events {
+		if query.DeviceId == "" || e.DeviceId == query.DeviceId {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func (f *schemaFixture) ListEventsCounted(query api.EventQuery) (api.EventList, error) {
+	events, err := f.ListEvents(query)
+	return api.EventList{TotalCount: len(events), Events: events}, err
+}
+
+func (f *schemaFixture) LatestEvent(deviceId string) (*api.Event, error) {
+	events, _ := f.ListEvents(api.EventQuery{DeviceId: deviceId})
+	if len(events) == 0 {
+		return nil, nil
+	}
+	return &events[len(events)-1], nil
+}
+
+func (f *schemaFixture) LatestPerDevice(ids []string) ([]api.Event, error) {
+	return nil, nil
+}
+
+func (f *schemaFixture) StreamEvents(query api.EventQuery, fn func(api.Event) error) error {
+	return nil
+}
+
+func (f *schemaFixture) ListEventsPaged(deviceId string, after string, max int) (api.EventPage, error) {
+	return api.EventPage{}, nil
+}
+
+func (f *schemaFixture) EventStats(deviceId string, field string, since int64, until int64) (api.EventStats, error) {
+	return api.EventStats{}, nil
+}
+
+func (f *schemaFixture) EventSeries(query api.SeriesQuery) ([]api.SeriesPoint, error) {
+	return nil, nil
+}
+
+func (f *schemaFixture) State() api.ConnectionState {
+	return api.Connected
+}
+
+func (f *schemaFixture) Stats() api.CacheInfo {
+	return api.CacheInfo{}
+}
+
+func (f *schemaFixture) LastSeen() map[string]int64 {
+	return map[string]int64{}
+}
+
+func (f *schemaFixture) setEnabled(ctx context.Context, id string, enabled bool) (api.Device, error) {
+	return api.Device{ID: id, Enabled: enabled}, nil
+}
+
+func (f *schemaFixture) update(ctx context.Context, id string, patch api.DevicePatch) (api.Device, error) {
+	return api.Device{ID: id}, nil
+}
+
+func (f *schemaFixture) auditLog(deviceId string) []api.AuditEntry {
+	return nil
+}
+
+func (f *schemaFixture) schema() graphql.Schema {
+	return createSchema(f.listDevices, f.getDevice, f, f, f.setEnabled, f.update, nil, f.auditLog, f.computeHeatIndex, 4, 0, true)
+}
+
+// Run the query against the schema, failing the test if it returns errors
+func runQuery(t *testing.T, schema graphql.Schema, query string) interface{} {
+	t.Helper()
+	result, _ := executeQuery(context.Background(), queryBody{Query: query}, schema, 0, true)
+	if len(result.Errors) > 0 {
+		t.Fatalf("query %s failed: %v", query, result.Errors)
+	}
+	return result.Data
+}
+
+// Run the query against the schema, returning the error messages
+func queryErrors(schema graphql.Schema, query string) []string {
+	result, _ := executeQuery(context.Background(), queryBody{Query: query}, schema, 0, true)
+	messages := make([]string, 0, len(result.Errors))
+	for _, err := range result.Errors {
+		messages = append(messages, err.Message)
+	}
+	return messages
+}
+
+// Fail the test unless the data encodes to the same JSON as want
+func assertJSON(t *testing.T, data interface{}, want string) {
+	t.Helper()
+	var expected interface{}
+	err := json.Unmarshal([]byte(want), &expected)
+	if err != nil {
+		t.Fatalf("invalid expected JSON %s: %v", want, err)
+	}
+	got, _ := json.Marshal(data)
+	wantJSON, _ := json.Marshal(expected)
+	if string(got) != string(wantJSON) {
+		t.Errorf("got %s, want %s", got, wantJSON)
+	}
+}
+
+func TestEventsDeviceId(t *testing.T) {
+	f := newSchemaFixture()
+	data := runQuery(t, f.schema(), `{ events(deviceId: "dev1") { deviceId creationTime } }`)
+	assertJSON(t, data, `{"events": [{"deviceId": "dev1", "creationTime": 100}]}`)
+	if len(f.queries) != 1 || f.queries[0].DeviceId != "dev1" {
+		t.Errorf("expected one query for dev1, got %+v", f.queries)
+	}
+}
+
+func TestEventsAllDevices(t *testing.T) {
+	f := newSchemaFixture()
+	data := runQuery(t, f.schema(), `{ events { deviceId } }`)
+	assertJSON(t, data, `{"events": [{"deviceId": "dev1"}, {"deviceId": "dev2"}]}`)
+	if len(f.queries) != 1 || f.queries[0].DeviceId != "" {
+		t.Errorf("expected one query for all devices, got %+v", f.queries)
+	}
+}
+
+func TestEventDataTemperature(t *testing.T) {
+	f := newSchemaFixture()
+	data := runQuery(t, f.schema(), `{ events { deviceId data { motion temperature { celsius humidity heatIndexCelsius } } } }`)
+	assertJSON(t, data, `{"events": [
+		{"deviceId": "dev1", "data": {"motion": true, "temperature": {"celsius": 21.5, "humidity": 40, "heatIndexCelsius": null}}},
+		{"deviceId": "dev2", "data": {"motion": false, "temperature": null}}
+	]}`)
+}
+
+func TestDevices(t *testing.T) {
+	f := newSchemaFixture()
+	data := runQuery(t, f.schema(), `{ devices { id name enabled latestEvent { creationTime } } }`)
+	assertJSON(t, data, `{"devices": [
+		{"id": "dev1", "name": "Greenhouse", "enabled": true, "latestEvent": {"creationTime": 100}},
+		{"id": "dev2", "name": "Shed", "enabled": false, "latestEvent": {"creationTime": 200}}
+	]}`)
+}
+
+func TestEventsDeviceIdArgument(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+		err   string
+	}{
+		{"omitted", `{ events { deviceId } }`, `{"events": [{"deviceId": "dev1"}, {"deviceId": "dev2"}]}`, ""},
+		{"empty", `{ events(deviceId: "") { deviceId } }`, "", "deviceId must not be empty"},
+		{"blank", `{ events(deviceId: "  ") { deviceId } }`, "", "deviceId must not be empty"},
+		{"valid", `{ events(deviceId: "dev2") { deviceId } }`, `{"events": [{"deviceId": "dev2"}]}`, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schema := newSchemaFixture().schema()
+			if test.err != "" {
+				errs := queryErrors(schema, test.query)
+				if len(errs) != 1 || errs[0] != test.err {
+					t.Errorf("expected error %q, got %q", test.err, errs)
+				}
+				return
+			}
+			assertJSON(t, runQuery(t, schema, test.query), test.want)
+		})
+	}
+}
+
+func TestDeviceFilter(t *testing.T) {
+	filter := deviceFilter(map[string]interface{}{"nameContains": "green", "hasSensor": "soil", "enabled": false})
+	if filter.NameContains != "green" || filter.HasSensor != "soil" || filter.Enabled == nil || *filter.Enabled {
+		t.Errorf("unexpected filter %+v", filter)
+	}
+	if filter := deviceFilter(map[string]interface{}{}); filter.Enabled != nil || filter.NameContains != "" {
+		t.Errorf("expected an empty filter without arguments, got %+v", filter)
+	}
+
+	data := runQuery(t, newSchemaFixture().schema(), `{ devices(nameContains: "GREEN") { id } devicesPage(enabled: false) { totalCount devices { id } } }`)
+	assertJSON(t, data, `{"devices": [{"id": "dev1"}], "devicesPage": {"totalCount": 1, "devices": [{"id": "dev2"}]}}`)
+}
+
+func TestComputeHeatIndex(t *testing.T) {
+	f := newSchemaFixture()
+	f.events = []api.Event{{DeviceId: "dev1", Data: map[string]interface{}{
+		"temperature": map[string]interface{}{"celcius": 32.0, "humidity": 70.0},
+	}}}
+	query := `{ events { data { temperature { heatIndexCelsius } } } }`
+	assertJSON(t, runQuery(t, f.schema(), query), `{"events": [{"data": {"temperature": {"heatIndexCelsius": null}}}]}`)
+
+	f.computeHeatIndex = true
+	heatIndex, _ := json.Marshal(api.HeatIndex(32, 70))
+	assertJSON(t, runQuery(t, f.schema(), query), `{"events": [{"data": {"temperature": {"heatIndexCelsius": `+string(heatIndex)+`}}}]}`)
+}
+
+func TestEventsInvalidQuery(t *testing.T) {
+	schema := newSchemaFixture().schema()
+	tests := map[string]string{
+		`{ events(max: -1) { deviceId } }`:                     "max must not be negative, got -1",
+		`{ eventList(since: 200, until: 100) { totalCount } }`: "until 100 is before since 200",
+	}
+	for query, want := range tests {
+		errs := queryErrors(schema, query)
+		if len(errs) != 1 || errs[0] != want {
+			t.Errorf("expected error %q for %s, got %q", want, query, errs)
+		}
+	}
+}
+
+func TestCelsiusSpellings(t *testing.T) {
+	f := newSchemaFixture()
+	f.events = []api.Event{{DeviceId: "dev1", Data: map[string]interface{}{
+		"temperature": map[string]interface{}{"celcius": 30.5, "humidity": 60.0, "heatindexCelcius": 34.25},
+	}}}
+	data := runQuery(t, f.schema(), `{ events { data { temperature { celsius celcius heatIndexCelsius heatindexCelcius } } } }`)
+	assertJSON(t, data, `{"events": [{"data": {"temperature": {"celsius": 30.5, "celcius": 30.5, "heatIndexCelsius": 34.25, "heatindexCelcius": 34.25}}}]}`)
+
+	data = runQuery(t, f.schema(), `{ __type(name: "Temperature") { fields(includeDeprecated: true) { name isDeprecated } } }`)
+	assertJSON(t, data, `{"__type": {"fields": [
+		{"name": "celcius", "isDeprecated": true},
+		{"name": "celsius", "isDeprecated": false},
+		{"name": "heatIndexCelsius", "isDeprecated": false},
+		{"name": "heatindexCelcius", "isDeprecated": true},
+		{"name": "humidity", "isDeprecated": false}
+	]}}`)
+}
+
+func TestMalformedEventData(t *testing.T) {
+	f := newSchemaFixture()
+	f.events = []api.Event{
+		{DeviceId: "number", Data: map[string]interface{}{"temperature": 21.5, "soil": "wet", "motion": "yes"}},
+		{DeviceId: "fields", Data: map[string]interface{}{
+			"temperature": map[string]interface{}{"celcius": "warm", "humidity": []interface{}{40.0}},
+			"soil":        map[string]interface{}{"humidity": []interface{}{"dry", 12.5}},
+			"motion":      1.0,
+		}},
+		{DeviceId: "nested", Data: map[string]interface{}{
+			"temperature": []interface{}{map[string]interface{}{"celcius": 21.5}},
+			"soil":        map[string]interface{}{"humidity": map[string]interface{}{"a": 1.0}},
+		}},
+		{DeviceId: "empty"},
+	}
+	data := runQuery(t, f.schema(), `{ events { deviceId data { motion temperature { celsius humidity } soil { humidity } } } }`)
+	assertJSON(t, data, `{"events": [
+		{"deviceId": "number", "data": {"motion": null, "temperature": null, "soil": null}},
+		{"deviceId": "fields", "data": {"motion": null, "temperature": {"celsius": null, "humidity": null}, "soil": {"humidity": null}}},
+		{"deviceId": "nested", "data": {"motion": null, "temperature": null, "soil": {"humidity": null}}},
+		{"deviceId": "empty", "data": {"motion": null, "temperature": null, "soil": null}}
+	]}`)
+
+	// The data as received is still available
+	data = runQuery(t, f.schema(), `{ events(deviceId: "number") { data { raw } } }`)
+	assertJSON(t, data, `{"events": [{"data": {"raw": {"temperature": 21.5, "soil": "wet", "motion": "yes"}}}]}`)
+}
+
+func TestScalarSensors(t *testing.T) {
+	f := newSchemaFixture()
+	f.events = []api.Event{
+		{DeviceId: "typed", Data: map[string]interface{}{"battery": 87.5, "light": 1200.0, "co2": 412.0, "pressure": 1013.25}},
+		{DeviceId: "wrong", Data: map[string]interface{}{"battery": "full", "light": true, "co2": 412.5, "pressure": map[string]interface{}{"hPa": 1013.25}}},
+	}
+	data := runQuery(t, f.schema(), `{ events { deviceId data { battery light co2 pressure } } }`)
+	assertJSON(t, data, `{"events": [
+		{"deviceId": "typed", "data": {"battery": 87.5, "light": 1200, "co2": 412, "pressure": 1013.25}},
+		{"deviceId": "wrong", "data": {"battery": null, "light": null, "co2": null, "pressure": null}}
+	]}`)
+}
+
+func TestWithoutCache(t *testing.T) {
+	f := newSchemaFixture()
+	var published []api.Event
+	publish := func(e api.Event) { published = append(published, e) }
+	schema := createSchema(f.listDevices, f.getDevice, f, nil, f.setEnabled, f.update, publish, f.auditLog, false, 4, 0, true)
+	tests := map[string]string{
+		`{ cacheInfo { totalEvents } }`:                                                  "cache information is not available in replay mode",
+		`{ staleDevices(thresholdSeconds: 60) { id } }`:                                  "stale devices are not available in replay mode",
+		`mutation { publishEvent(deviceId: "dev1", data: {motion: true}) { deviceId } }`: "publishing events is not available in replay mode",
+	}
+	for query, want := range tests {
+		errs := queryErrors(schema, query)
+		if len(errs) != 1 || errs[0] != want {
+			t.Errorf("expected error %q for %s, got %q", want, query, errs)
+		}
+	}
+	if len(published) != 0 {
+		t.Errorf("expected no events to be published, got %+v", published)
+	}
+	// Event queries are still served by the store
+	assertJSON(t, runQuery(t, schema, `{ events(deviceId: "dev2") { deviceId } }`), `{"events": [{"deviceId": "dev2"}]}`)
+}
+
+func TestAllDevicesQueryDisabled(t *testing.T) {
+	f := newSchemaFixture()
+	schema := createSchema(f.listDevices, f.getDevice, f, f, f.setEnabled, f.update, nil, f.auditLog, false, 4, 0, false)
+	tests := map[string]string{
+		`{ events { deviceId } }`:                           "deviceId, deviceIdPrefix or group is required, queries for all devices are disabled",
+		`{ eventsConnection { pageInfo { hasNextPage } } }`: "deviceId is required, queries for all devices are disabled",
+		`{ latestEvents { deviceId } }`:                     "deviceIds is required, queries for all devices are disabled",
+		`{ latestEvents(deviceIds: []) { deviceId } }`:      "deviceIds is required, queries for all devices are disabled",
+	}
+	for query, want := range tests {
+		errs := queryErrors(schema, query)
+		if len(errs) != 1 || errs[0] != want {
+			t.Errorf("expected error %q for %s, got %q", want, query, errs)
+		}
+	}
+	runQuery(t, schema, `{ events(deviceId: "dev1") { deviceId } latestEvents(deviceIds: ["dev1"]) { deviceId } }`)
+
+	export := exportHandler(f.StreamEvents, false)
+	w := httptest.NewRecorder()
+	export.ServeHTTP(w, httptest.NewRequest("GET", "/export/events", nil))
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "deviceId is required") {
+		t.Errorf("expected the export of all devices to be rejected, got %d %q", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	export.ServeHTTP(w, httptest.NewRequest("GET", "/export/events?deviceId=dev1", nil))
+	if w.Code != 200 {
+		t.Errorf("expected the export of a device to succeed, got %d %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,42 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package main
+
+// GraphiQL page served to browsers visiting the GraphQL endpoint
+const playgroundPage = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>Dings API</title>
+  <link rel="stylesheet" href="https://unpkg.com/graphiql@0.17.5/graphiql.min.css">
+  <style>
+    body { height: 100vh; margin: 0; overflow: hidden; }
+    #graphiql { height: 100vh; }
+  </style>
+</head>
+<body>
+  <div id="graphiql">Loading...</div>
+  <script src="https://unpkg.com/react@16.12.0/umd/react.production.min.js"></script>
+  <script src="https://unpkg.com/react-dom@16.12.0/umd/react-dom.production.min.js"></script>
+  <script src="https://unpkg.com/graphiql@0.17.5/graphiql.min.js"></script>
+  <script>
+    function fetcher(params) {
+      return fetch(window.location.pathname, {
+        method: "POST",
+        headers: { "Accept": "application/json", "Content-Type": "application/json" },
+        body: JSON.stringify(params),
+        credentials: "same-origin"
+      }).then(function (response) {
+        return response.json();
+      });
+    }
+    ReactDOM.render(
+      React.createElement(GraphiQL, { fetcher: fetcher }),
+      document.getElementById("graphiql")
+    );
+  </script>
+</body>
+</html>
+`
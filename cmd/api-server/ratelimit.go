@@ -0,0 +1,131 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package main
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+// Minimum time without requests after which the limiter of a client is removed
+const clientIdleTimeout = time.Minute
+
+var requestsThrottled = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "dings_requests_throttled_total",
+	Help: "Number of HTTP requests rejected because the client exceeded the request rate limit",
+})
+
+type clientBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// Limits the request rate of each client with a token bucket, keyed by the client IP
+type clientLimiter struct {
+	limit rate.Limit
+	burst int
+	// Take the client IP from X-Forwarded-For, set by a trusted proxy in front of the server
+	trustProxy bool
+	// Time without requests after which a bucket is full again, and can be removed
+	idle    time.Duration
+	mutex   sync.Mutex
+	clients map[string]*clientBucket
+}
+
+func newClientLimiter(perSecond float64, burst int, trustProxy bool) *clientLimiter {
+	idle := time.Duration(float64(burst) / perSecond * float64(time.Second))
+	if idle < clientIdleTimeout {
+		idle = clientIdleTimeout
+	}
+	return &clientLimiter{
+		limit:      rate.Limit(perSecond),
+		burst:      burst,
+		trustProxy: trustProxy,
+		idle:       idle,
+		clients:    make(map[string]*clientBucket),
+	}
+}
+
+// Take a token from the bucket of the client, returning false if it is empty
+func (l *clientLimiter) allow(ip string, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	bucket, ok := l.clients[ip]
+	if !ok {
+		bucket = &clientBucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[ip] = bucket
+	}
+	bucket.lastSeen = now
+	return bucket.limiter.AllowN(now, 1)
+}
+
+// Remove the buckets of clients that have been idle long enough for their buckets to be full
+func (l *clientLimiter) prune(now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for ip, bucket := range l.clients {
+		if now.Sub(bucket.lastSeen) > l.idle {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+// Prune idle clients until the context is done
+func (l *clientLimiter) Run(ctx context.Context) {
+	ticker := time.NewTicker(l.idle)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.prune(now)
+		}
+	}
+}
+
+// Wrap a handler to answer requests from clients that exceed the rate limit with 429. Requests
+// for the exempt paths, such as probes and metrics scrapes, are not limited.
+func (l *clientLimiter) handler(next http.Handler, exempt ...string) http.Handler {
+	retryAfter := strconv.Itoa(int(math.Ceil(1 / float64(l.limit))))
+	exemptPaths := make(map[string]bool, len(exempt))
+	for _, path := range exempt {
+		exemptPaths[path] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !exemptPaths[r.URL.Path] && !l.allow(clientIP(r, l.trustProxy), time.Now()) {
+			requestsThrottled.Inc()
+			w.Header().Set("Retry-After", retryAfter)
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Returns the IP of the client of a request. With trustProxy, this is the last address in
+// X-Forwarded-For, which was added by the proxy, since earlier addresses are set by the client.
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			addresses := strings.Split(forwarded, ",")
+			return strings.TrimSpace(addresses[len(addresses)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,34 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRateLimitExemptPaths(t *testing.T) {
+	limiter := newClientLimiter(1, 1, false)
+	handler := limiter.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "/healthz", "/readyz", "/metrics")
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/graphql", http.StatusOK},
+		{"/graphql", http.StatusTooManyRequests},
+		{"/healthz", http.StatusOK},
+		{"/readyz", http.StatusOK},
+		{"/metrics", http.StatusOK},
+		{"/export/events", http.StatusTooManyRequests},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", test.path, nil))
+		if w.Code != test.want {
+			t.Errorf("expected %d for %s, got %d", test.want, test.path, w.Code)
+		}
+	}
+}
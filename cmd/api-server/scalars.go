@@ -0,0 +1,104 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// graphql.Int is 32-bit, which is too small for epoch timestamps in milliseconds or beyond 2038
+var timestampType = graphql.NewScalar(graphql.ScalarConfig{
+	Name:        "Timestamp",
+	Description: "Seconds since the Unix epoch, as a 64-bit integer",
+	Serialize:   coerceTimestamp,
+	ParseValue:  coerceTimestamp,
+	ParseLiteral: func(valueAST ast.Value) interface{} {
+		switch v := valueAST.(type) {
+		case *ast.IntValue:
+			if value, err := strconv.ParseInt(v.Value, 10, 64); err == nil {
+				return value
+			}
+		case *ast.StringValue:
+			if value, err := strconv.ParseInt(v.Value, 10, 64); err == nil {
+				return value
+			}
+		}
+		return nil
+	},
+})
+
+func coerceTimestamp(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int64:
+		return v
+	case *int64:
+		if v == nil {
+			return nil
+		}
+		return *v
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case float64:
+		// Variables decoded from JSON arrive as float64
+		if v != math.Trunc(v) || math.Abs(v) > 1<<53 {
+			return nil
+		}
+		return int64(v)
+	case string:
+		if value, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return value
+		}
+	}
+	return nil
+}
+
+// Arbitrary JSON values. Numbers in literals are represented as json.Number, the same as for decoded
+// event data, so that large integers keep their precision.
+var jsonType = graphql.NewScalar(graphql.ScalarConfig{
+	Name:        "JSON",
+	Description: "Arbitrary JSON value",
+	Serialize: func(value interface{}) interface{} {
+		return value
+	},
+	ParseValue: func(value interface{}) interface{} {
+		return value
+	},
+	ParseLiteral: parseJSONLiteral,
+})
+
+func parseJSONLiteral(valueAST ast.Value) interface{} {
+	switch v := valueAST.(type) {
+	case *ast.ObjectValue:
+		obj := make(map[string]interface{})
+		for _, field := range v.Fields {
+			obj[field.Name.Value] = parseJSONLiteral(field.Value)
+		}
+		return obj
+	case *ast.ListValue:
+		list := make([]interface{}, 0, len(v.Values))
+		for _, item := range v.Values {
+			list = append(list, parseJSONLiteral(item))
+		}
+		return list
+	case *ast.IntValue:
+		return json.Number(v.Value)
+	case *ast.FloatValue:
+		return json.Number(v.Value)
+	case *ast.BooleanValue:
+		return v.Value
+	case *ast.StringValue:
+		return v.Value
+	case *ast.EnumValue:
+		return v.Value
+	}
+	return nil
+}
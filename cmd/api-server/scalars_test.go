@@ -0,0 +1,68 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/lulf/dings-api/pkg/api"
+)
+
+func TestCoerceTimestamp(t *testing.T) {
+	large := int64(1) << 40
+	tests := []struct {
+		value interface{}
+		want  interface{}
+	}{
+		{int64(4102444800), int64(4102444800)},
+		{&large, large},
+		{(*int64)(nil), nil},
+		{int(5), int64(5)},
+		{float64(1700000000000), int64(1700000000000)},
+		{float64(1.5), nil},
+		{"4294967296", int64(4294967296)},
+		{"soon", nil},
+		{true, nil},
+	}
+	for _, test := range tests {
+		if got := coerceTimestamp(test.value); got != test.want {
+			t.Errorf("coerceTimestamp(%#v) = %#v, want %#v", test.value, got, test.want)
+		}
+	}
+}
+
+func TestTimestampRoundTrip(t *testing.T) {
+	const creationTime = int64(1) << 32
+	f := newSchemaFixture()
+	f.events = []api.Event{{DeviceId: "dev1", CreationTime: creationTime}}
+	schema := f.schema()
+
+	// Since may not be far in the future, so the bounds beyond 2^31 are given as until. The queries
+	// are run one by one, since the fields of a query are not resolved in a fixed order.
+	data := runQuery(t, schema, `{ events(until: 4294967296) { creationTime } }`)
+	assertJSON(t, data, `{"events": [{"creationTime": 4294967296}]}`)
+	if f.queries[0].Until != 4294967296 {
+		t.Errorf("expected until 4294967296, got %d", f.queries[0].Until)
+	}
+	data = runQuery(t, schema, `{ events(since: "1700000000", until: "5000000000") { creationTime } }`)
+	assertJSON(t, data, `{"events": [{"creationTime": 4294967296}]}`)
+	if f.queries[1].Since != 1700000000 || f.queries[1].Until != 5000000000 {
+		t.Errorf("expected since 1700000000 and until 5000000000, got %d and %d", f.queries[1].Since, f.queries[1].Until)
+	}
+
+	// Variables decoded from a JSON request body are float64
+	request := queryBody{
+		Query:     `query Events($until: Timestamp) { events(until: $until) { deviceId } }`,
+		Variables: map[string]interface{}{"until": float64(1700000000000)},
+	}
+	result, _ := executeQuery(context.Background(), request, schema, 0, true)
+	if len(result.Errors) > 0 {
+		t.Fatalf("query failed: %v", result.Errors)
+	}
+	if f.queries[2].Until != 1700000000000 {
+		t.Errorf("expected until 1700000000000, got %d", f.queries[2].Until)
+	}
+}
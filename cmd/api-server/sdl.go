@@ -0,0 +1,136 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+)
+
+// Scalars defined by the GraphQL spec, which are not printed in the SDL
+var builtinScalars = map[string]bool{
+	"String":  true,
+	"Int":     true,
+	"Float":   true,
+	"Boolean": true,
+	"ID":      true,
+}
+
+// Print the schema in the GraphQL schema definition language. Types and fields are sorted by name.
+func printSchema(schema graphql.Schema) string {
+	typeMap := schema.TypeMap()
+	names := make([]string, 0, len(typeMap))
+	for name := range typeMap {
+		if !strings.HasPrefix(name, "__") && !builtinScalars[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var definitions []string
+	for _, name := range names {
+		switch t := typeMap[name].(type) {
+		case *graphql.Scalar:
+			definitions = append(definitions, fmt.Sprintf("scalar %s", t.Name()))
+		case *graphql.Enum:
+			var values []string
+			for _, value := range t.Values() {
+				values = append(values, "  "+value.Name)
+			}
+			definitions = append(definitions, fmt.Sprintf("enum %s {\n%s\n}", t.Name(), strings.Join(values, "\n")))
+		case *graphql.InputObject:
+			fields := t.Fields()
+			var lines []string
+			for _, fieldName := range sortedKeys(fields) {
+				field := fields[fieldName]
+				lines = append(lines, "  "+printInputValue(field.Name(), field.Type, field.DefaultValue))
+			}
+			definitions = append(definitions, fmt.Sprintf("input %s {\n%s\n}", t.Name(), strings.Join(lines, "\n")))
+		case *graphql.Object:
+			fields := t.Fields()
+			var lines []string
+			for _, fieldName := range sortedKeys(fields) {
+				lines = append(lines, "  "+printField(fields[fieldName]))
+			}
+			definitions = append(definitions, fmt.Sprintf("type %s {\n%s\n}", t.Name(), strings.Join(lines, "\n")))
+		}
+	}
+	return strings.Join(definitions, "\n\n") + "\n"
+}
+
+func printField(field *graphql.FieldDefinition) string {
+	printed := field.Name
+	args := append([]*graphql.Argument{}, field.Args...)
+	if len(args) > 0 {
+		sort.Slice(args, func(i, j int) bool { return args[i].Name() < args[j].Name() })
+		var values []string
+		for _, arg := range args {
+			values = append(values, printInputValue(arg.Name(), arg.Type, arg.DefaultValue))
+		}
+		printed += "(" + strings.Join(values, ", ") + ")"
+	}
+	printed += ": " + field.Type.String()
+	if field.DeprecationReason != "" {
+		reason, _ := json.Marshal(field.DeprecationReason)
+		printed += fmt.Sprintf(" @deprecated(reason: %s)", reason)
+	}
+	return printed
+}
+
+func printInputValue(name string, t graphql.Input, defaultValue interface{}) string {
+	if defaultValue == nil {
+		return fmt.Sprintf("%s: %s", name, t)
+	}
+	return fmt.Sprintf("%s: %s = %s", name, t, printValue(t, defaultValue))
+}
+
+// Print a default value as a GraphQL literal
+func printValue(t graphql.Input, value interface{}) string {
+	if nonNull, ok := t.(*graphql.NonNull); ok {
+		t = nonNull.OfType.(graphql.Input)
+	}
+	if enum, ok := t.(*graphql.Enum); ok {
+		for _, v := range enum.Values() {
+			if v.Value == value {
+				return v.Name
+			}
+		}
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(encoded)
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch fields := m.(type) {
+	case graphql.FieldDefinitionMap:
+		for key := range fields {
+			keys = append(keys, key)
+		}
+	case graphql.InputObjectFieldMap:
+		for key := range fields {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Serve the schema in the GraphQL schema definition language
+func schemaHandler(schema graphql.Schema) http.HandlerFunc {
+	sdl := printSchema(schema)
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, sdl)
+	}
+}
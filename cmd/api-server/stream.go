@@ -0,0 +1,164 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lulf/dings-api/pkg/api"
+)
+
+type deviceSubscriberFunc func() (<-chan api.DeviceChange, func())
+type eventSubscriberFunc func() (<-chan api.Event, func())
+
+// A server-sent events stream on an HTTP response
+type eventStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+
+	controller   *http.ResponseController
+	writeTimeout time.Duration
+}
+
+// Start a server-sent events response, where each write must complete within the write timeout.
+// Fails if the response writer does not support flushing.
+func startEventStream(w http.ResponseWriter, writeTimeout time.Duration) (*eventStream, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, fmt.Errorf("streaming is not supported")
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return &eventStream{w: w, flusher: flusher, controller: http.NewResponseController(w), writeTimeout: writeTimeout}, nil
+}
+
+// Logs once that write deadlines are not supported, so streams are written without a timeout
+var deadlineUnsupported sync.Once
+
+// Set the deadline of the next write. Without a deadline, a write to a client that stopped reading
+// blocks once the send buffers are full, until the operating system gives up on the connection.
+func (s *eventStream) setDeadline(deadline time.Time) error {
+	err := s.controller.SetWriteDeadline(deadline)
+	if errors.Is(err, http.ErrNotSupported) {
+		deadlineUnsupported.Do(func() {
+			log.Println("Event stream write deadlines are not supported by the response writer, -stream-write-timeout has no effect")
+		})
+		return nil
+	}
+	return err
+}
+
+// Write to the stream and flush, failing if the client does not take the data in time
+func (s *eventStream) write(format string, args ...interface{}) error {
+	if s.writeTimeout > 0 {
+		if err := s.setDeadline(time.Now().Add(s.writeTimeout)); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(s.w, format, args...)
+	if err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// Clear the write deadline, so it does not apply to later requests on the connection
+func (s *eventStream) end() {
+	s.setDeadline(time.Time{})
+}
+
+// Write a named event with JSON encoded data
+func (s *eventStream) send(name string, data interface{}) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return s.write("event: %s\ndata: %s\n\n", name, encoded)
+}
+
+// Write a comment, which keeps intermediaries from closing an idle connection
+func (s *eventStream) heartbeat() error {
+	return s.write(": heartbeat\n\n")
+}
+
+// Stream device registry changes as server-sent events until the client disconnects or the server
+// shuts down
+func deviceStreamHandler(subscribe deviceSubscriberFunc, heartbeatInterval time.Duration, writeTimeout time.Duration, shutdown <-chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		changes, unsubscribe := subscribe()
+		defer unsubscribe()
+
+		stream, err := startEventStream(w, writeTimeout)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer stream.end()
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-shutdown:
+				return
+			case change := <-changes:
+				err = stream.send("deviceChanged", change)
+			case <-heartbeat.C:
+				err = stream.heartbeat()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Stream new events as server-sent events until the client disconnects or the server shuts down,
+// optionally for a single device
+func eventStreamHandler(subscribe eventSubscriberFunc, heartbeatInterval time.Duration, writeTimeout time.Duration, shutdown <-chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deviceId := r.URL.Query().Get("deviceId")
+		events, unsubscribe := subscribe()
+		defer unsubscribe()
+
+		stream, err := startEventStream(w, writeTimeout)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer stream.end()
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-shutdown:
+				return
+			case event := <-events:
+				if deviceId != "" && event.DeviceId != deviceId {
+					continue
+				}
+				err = stream.send("event", event)
+			case <-heartbeat.C:
+				err = stream.heartbeat()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lulf/dings-api/pkg/api"
+)
+
+// Response recorder that records the write deadlines set through http.ResponseController
+type deadlineRecorder struct {
+	*httptest.ResponseRecorder
+	mutex     sync.Mutex
+	deadlines []time.Time
+	written   chan struct{}
+}
+
+func (r *deadlineRecorder) SetWriteDeadline(deadline time.Time) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.deadlines = append(r.deadlines, deadline)
+	return nil
+}
+
+func (r *deadlineRecorder) Write(data []byte) (int, error) {
+	n, err := r.ResponseRecorder.Write(data)
+	select {
+	case r.written <- struct{}{}:
+	default:
+	}
+	return n, err
+}
+
+func TestEventStreamWriteDeadline(t *testing.T) {
+	events := make(chan api.Event, 1)
+	events <- api.Event{DeviceId: "dev1", CreationTime: 100}
+	subscribe := func() (<-chan api.Event, func()) { return events, func() {} }
+	// The stream is written through the wrapped response writers of the server
+	handler := tracingHandler(accessLogHandler(eventStreamHandler(subscribe, time.Hour, 5*time.Second, nil)))
+
+	recorder := &deadlineRecorder{ResponseRecorder: httptest.NewRecorder(), written: make(chan struct{}, 1)}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	start := time.Now()
+	go func() {
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/events/stream", nil).WithContext(ctx))
+		close(done)
+	}()
+	select {
+	case <-recorder.written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the event to be written")
+	}
+	cancel()
+	<-done
+
+	if !strings.Contains(recorder.Body.String(), "event: event\n") {
+		t.Errorf("expected an event message, got %q", recorder.Body.String())
+	}
+	if len(recorder.deadlines) < 2 {
+		t.Fatalf("expected a deadline for the write and one clearing it, got %v", recorder.deadlines)
+	}
+	deadline := recorder.deadlines[0]
+	if deadline.Before(start.Add(5*time.Second)) || deadline.After(time.Now().Add(5*time.Second)) {
+		t.Errorf("expected a deadline 5s after the write, got %v", deadline)
+	}
+	if last := recorder.deadlines[len(recorder.deadlines)-1]; !last.IsZero() {
+		t.Errorf("expected the deadline to be cleared when the stream ends, got %v", last)
+	}
+}
+
+func TestEventStreamShutdown(t *testing.T) {
+	subscribe := func() (<-chan api.Event, func()) { return make(chan api.Event), func() {} }
+	shutdown := make(chan struct{})
+	handler := eventStreamHandler(subscribe, time.Hour, 0, shutdown)
+
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/events/stream", nil))
+		close(done)
+	}()
+	// The request context is not cancelled on shutdown, the stream ends by itself
+	close(shutdown)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the stream to end on shutdown")
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/lulf/dings-api/pkg/api"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/lulf/dings-api/cmd/api-server")
+
+// Export spans over OTLP/HTTP when an OTLP endpoint is set in the environment. The exporter is
+// configured by the standard OTEL_EXPORTER_OTLP_* variables, and the returned function flushes
+// and stops it.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	// Trace context is propagated even when spans are not exported
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error creating OTLP exporter: %v", err)
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceNameKey.String("dings-api")),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv())
+	if err != nil {
+		return nil, fmt.Errorf("error creating trace resource: %v", err)
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Wrap a handler with a span for each request, continuing the trace of the caller if any
+func tracingHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+r.URL.Path,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPServerAttributesFromHTTPRequest("dings-api", "", r)...))
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(recorder.status)...)
+		span.SetStatus(semconv.SpanStatusFromHTTPStatusCodeAndSpanKind(recorder.status, trace.SpanKindServer))
+	})
+}
+
+// List events from the cache in a span of the request
+func tracedListEvents(ctx context.Context, eventFetcher eventFetcherFunc, query api.EventQuery) ([]api.Event, error) {
+	var events []api.Event
+	err := traceListEvents(ctx, query, func() (err error) {
+		events, err = eventFetcher(query)
+		return err
+	})
+	return events, err
+}
+
+// Run a listing of events from the cache in a ListEvents span
+func traceListEvents(ctx context.Context, query api.EventQuery, list func() error) error {
+	_, span := tracer.Start(ctx, "ListEvents", trace.WithAttributes(attribute.String("deviceId", query.DeviceId)))
+	defer span.End()
+	err := list()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/kinds"
+	"github.com/graphql-go/graphql/language/visitor"
+)
+
+// Validation rule rejecting operations whose selections are nested deeper than maxDepth.
+// Introspection fields are not counted, so that tooling can always load the schema.
+func maxDepthRule(maxDepth int) graphql.ValidationRuleFn {
+	return func(context *graphql.ValidationContext) *graphql.ValidationRuleInstance {
+		return &graphql.ValidationRuleInstance{
+			VisitorOpts: &visitor.VisitorOptions{
+				KindFuncMap: map[string]visitor.NamedVisitFuncs{
+					kinds.OperationDefinition: {
+						Kind: func(p visitor.VisitFuncParams) (string, interface{}) {
+							if op, ok := p.Node.(*ast.OperationDefinition); ok {
+								depth := selectionDepth(context, op.SelectionSet, map[string]bool{})
+								if depth > maxDepth {
+									context.ReportError(gqlerrors.NewError(
+										fmt.Sprintf("Query depth %d exceeds the maximum of %d", depth, maxDepth),
+										[]ast.Node{op}, "", nil, []int{}, nil))
+								}
+							}
+							return visitor.ActionSkip, nil
+						},
+					},
+				},
+			},
+		}
+	}
+}
+
+func selectionDepth(context *graphql.ValidationContext, selectionSet *ast.SelectionSet, visited map[string]bool) int {
+	if selectionSet == nil {
+		return 0
+	}
+	max := 0
+	for _, selection := range selectionSet.Selections {
+		depth := 0
+		switch s := selection.(type) {
+		case *ast.Field:
+			if strings.HasPrefix(s.Name.Value, "__") {
+				continue
+			}
+			depth = 1 + selectionDepth(context, s.SelectionSet, visited)
+		case *ast.InlineFragment:
+			depth = selectionDepth(context, s.SelectionSet, visited)
+		case *ast.FragmentSpread:
+			name := s.Name.Value
+			// Fragment cycles are reported by the standard rules
+			if visited[name] {
+				continue
+			}
+			if fragment := context.Fragment(name); fragment != nil {
+				visited[name] = true
+				depth = selectionDepth(context, fragment.SelectionSet, visited)
+				delete(visited, name)
+			}
+		}
+		if depth > max {
+			max = depth
+		}
+	}
+	return max
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMaxDepth(t *testing.T) {
+	schema := newSchemaFixture().schema()
+	tests := []struct {
+		name  string
+		query string
+		err   string
+	}{
+		{"within limit", `{ devices { latestEvent { deviceId } } }`, ""},
+		{"nested", `{ devices { latestEvent { data { temperature { celsius } } } } }`, "Query depth 5 exceeds the maximum of 3"},
+		{"fragment", `{ devices { ...latest } } fragment latest on Device { latestEvent { data { motion } } }`, "Query depth 4 exceeds the maximum of 3"},
+		{"introspection", `{ __schema { types { fields { type { name } } } } }`, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, status := executeQuery(context.Background(), queryBody{Query: test.query}, schema, 3, true)
+			if test.err == "" {
+				if status != http.StatusOK || len(result.Errors) > 0 {
+					t.Errorf("expected query to be accepted, got %d %v", status, result.Errors)
+				}
+				return
+			}
+			if status != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d", status)
+			}
+			if len(result.Errors) != 1 || result.Errors[0].Message != test.err {
+				t.Errorf("expected error %q, got %v", test.err, result.Errors)
+			}
+		})
+	}
+}
+
+func TestMaxQueryBytes(t *testing.T) {
+	handler := graphqlHandler(newSchemaFixture().schema(), 64, 0, false)
+
+	small := `{"query": "{ devices { id } }"}`
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/graphql", strings.NewReader(small)))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200 for a small query, got %d: %s", w.Code, w.Body.String())
+	}
+
+	large := `{"query": "{ devices { ` + strings.Repeat("id ", 30) + `} }"}`
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/graphql", strings.NewReader(large)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an oversized query, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "request body too large") {
+		t.Errorf("expected the error to mention the body size, got %q", w.Body.String())
+	}
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// Renames of event data keys, such as "temp" to "temperature". Keys are renamed at any nesting level.
+type FieldAliases map[string]string
+
+// Load aliases from a JSON file containing an object of alias to key names
+func LoadFieldAliases(file string) (FieldAliases, error) {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var aliases FieldAliases
+	err = json.Unmarshal(contents, &aliases)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing field aliases in %s: %v", file, err)
+	}
+	for alias, key := range aliases {
+		if alias == "" || key == "" {
+			return nil, fmt.Errorf("empty field alias in %s", file)
+		}
+		if _, ok := aliases[key]; ok {
+			return nil, fmt.Errorf("field alias %s maps to another alias %s in %s", alias, key, file)
+		}
+	}
+	return aliases, nil
+}
+
+// Rename aliased keys in the data, in place. An alias is left as is if the data also has the key it maps to.
+func (a FieldAliases) Normalize(data map[string]interface{}) {
+	for key, value := range data {
+		if nested, ok := value.(map[string]interface{}); ok {
+			a.Normalize(nested)
+		}
+		target, ok := a[key]
+		if !ok {
+			continue
+		}
+		if _, exists := data[target]; exists {
+			continue
+		}
+		data[target] = value
+		delete(data, key)
+	}
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package api
+
+import (
+	"sync"
+)
+
+// A change of the enabled state of a device, made through the API
+type AuditEntry struct {
+	// Time of the change
+	Time     int64  `json:"time"`
+	DeviceId string `json:"deviceId"`
+	// Enabled state before the change, nil if it could not be looked up
+	PreviousEnabled *bool `json:"previousEnabled"`
+	Enabled         bool  `json:"enabled"`
+	// Authenticated user that made the change, empty if the API is not authenticated
+	Principal string `json:"principal"`
+}
+
+// Ring buffer of the most recent device changes
+type auditLog struct {
+	mutex   sync.Mutex
+	entries []AuditEntry
+	next    int
+}
+
+func NewAuditLog(size int) *auditLog {
+	return &auditLog{entries: make([]AuditEntry, 0, size)}
+}
+
+func (l *auditLog) Add(entry AuditEntry) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if cap(l.entries) == 0 {
+		return
+	}
+	if len(l.entries) < cap(l.entries) {
+		l.entries = append(l.entries, entry)
+		return
+	}
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % len(l.entries)
+}
+
+// Returns the kept entries for the device, or all devices if deviceId is empty, oldest first
+func (l *auditLog) List(deviceId string) []AuditEntry {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	result := make([]AuditEntry, 0)
+	for _, entries := range [][]AuditEntry{l.entries[l.next:], l.entries[:l.next]} {
+		for _, entry := range entries {
+			if deviceId == "" || entry.DeviceId == deviceId {
+				result = append(result, entry)
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package api
+
+import (
+	"reflect"
+)
+
+// Number of readings collapsed into the event
+func (e Event) Count() int {
+	return 1 + len(e.Repeats)
+}
+
+// Creation time of the newest reading collapsed into the event
+func (e Event) LastSeen() int64 {
+	if len(e.Repeats) == 0 {
+		return e.CreationTime
+	}
+	return e.Repeats[len(e.Repeats)-1]
+}
+
+// Returns the i-th reading collapsed into the event, as a plain event
+func (e Event) reading(i int) Event {
+	if i > 0 {
+		e.CreationTime = e.Repeats[i-1]
+	}
+	e.Repeats = nil
+	return e
+}
+
+// Returns the readings collapsed into the event, oldest first
+func (e Event) Expand() []Event {
+	ret := make([]Event, 0, e.Count())
+	for i := 0; i < e.Count(); i++ {
+		ret = append(ret, e.reading(i))
+	}
+	return ret
+}
+
+// Returns true if the event has a reading created at the given time
+func (e Event) hasReading(creationTime int64) bool {
+	if e.CreationTime == creationTime {
+		return true
+	}
+	for _, t := range e.Repeats {
+		if t == creationTime {
+			return true
+		}
+	}
+	return false
+}
+
+// Collapse the readings back into an event, the first reading becomes the event
+func compactReadings(readings []Event) Event {
+	e := readings[0]
+	for _, r := range readings[1:] {
+		e.Repeats = append(e.Repeats, r.CreationTime)
+	}
+	return e
+}
+
+// Collapse the event into the previous event from the device if it has the same data. Returns false
+// if the event must be stored by itself. Must be called with the mutex held.
+func (cache *eventCache) compact(event Event) bool {
+	indexes := cache.deviceIndex[event.DeviceId]
+	if len(indexes) == 0 {
+		return false
+	}
+	previous := &cache.data[indexes[len(indexes)-1]-cache.base]
+	if previous.Topic != event.Topic || event.CreationTime < previous.LastSeen() || !reflect.DeepEqual(previous.Data, event.Data) {
+		return false
+	}
+	previous.Repeats = append(previous.Repeats, event.CreationTime)
+	previous.Repeats = append(previous.Repeats, event.Repeats...)
+	return true
+}
+
+// Remove the readings of a compacted event created before since, keeping the newer ones
+func trimReadings(e Event, since int64) Event {
+	for len(e.Repeats) > 0 && e.CreationTime < since {
+		e.CreationTime = e.Repeats[0]
+		e.Repeats = e.Repeats[1:]
+	}
+	if len(e.Repeats) == 0 {
+		e.Repeats = nil
+	}
+	return e
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package api
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompactExpandRoundTrip(t *testing.T) {
+	cache := newTestCache(1000, EventStoreOptions{CompactRepeats: true})
+	on := map[string]interface{}{"motion": true}
+	off := map[string]interface{}{"motion": false}
+	events := []Event{
+		{DeviceId: "dev1", CreationTime: 100, Topic: "events", Data: on},
+		{DeviceId: "dev1", CreationTime: 110, Topic: "events", Data: on},
+		{DeviceId: "dev2", CreationTime: 115, Topic: "events", Data: on},
+		{DeviceId: "dev1", CreationTime: 120, Topic: "events", Data: on},
+		{DeviceId: "dev1", CreationTime: 130, Topic: "events", Data: off},
+		{DeviceId: "dev1", CreationTime: 140, Topic: "other", Data: off},
+		{DeviceId: "dev1", CreationTime: 150, Topic: "other", Data: off},
+	}
+	for _, e := range events {
+		cache.ingest(e, 200)
+	}
+
+	if got := creationTimes(cache.data); !reflect.DeepEqual(got, []int64{100, 115, 130, 140}) {
+		t.Fatalf("expected the repeats to be collapsed, got events %v", got)
+	}
+	first := cache.data[0]
+	if first.Count() != 3 || first.LastSeen() != 120 {
+		t.Errorf("expected 3 readings until 120, got %d until %d", first.Count(), first.LastSeen())
+	}
+
+	var expanded []Event
+	for i := 0; i < cache.numStored("dev1"); i++ {
+		expanded = append(expanded, cache.stored("dev1", i).Expand()...)
+	}
+	var want []Event
+	for _, e := range events {
+		if e.DeviceId == "dev1" {
+			want = append(want, e)
+		}
+	}
+	if !reflect.DeepEqual(expanded, want) {
+		t.Errorf("expanding gave %+v, want %+v", expanded, want)
+	}
+	if compacted := compactReadings(first.Expand()); !reflect.DeepEqual(compacted, first) {
+		t.Errorf("collapsing the expanded readings gave %+v, want %+v", compacted, first)
+	}
+}
+
+func TestTrimReadings(t *testing.T) {
+	e := Event{DeviceId: "dev1", CreationTime: 100, Repeats: []int64{110, 120}}
+	tests := []struct {
+		since int64
+		want  []int64
+	}{
+		{100, []int64{100, 110, 120}},
+		{105, []int64{110, 120}},
+		{120, []int64{120}},
+		// The newest reading is kept, the event itself is removed by pruning
+		{200, []int64{120}},
+	}
+	for _, test := range tests {
+		got := trimReadings(e, test.since)
+		if times := creationTimes(got.Expand()); !reflect.DeepEqual(times, test.want) {
+			t.Errorf("trimReadings(since: %d) kept %v, want %v", test.since, times, test.want)
+		}
+	}
+	if trimReadings(e, 200).Repeats != nil {
+		t.Error("expected no repeats after trimming all but one reading")
+	}
+}
+
+func TestMatchReadings(t *testing.T) {
+	stored := Event{DeviceId: "dev1", CreationTime: 100, Repeats: []int64{110, 120, 130}}
+	tests := []struct {
+		name  string
+		query EventQuery
+		want  [][]int64
+	}{
+		{"all", EventQuery{}, [][]int64{{100}, {110}, {120}, {130}}},
+		{"bounded", EventQuery{Since: 105, Until: 125}, [][]int64{{110}, {120}}},
+		{"descending", EventQuery{Order: Descending, Since: 105}, [][]int64{{130}, {120}, {110}}},
+		{"compacted", EventQuery{Compacted: true, Since: 105}, [][]int64{{110, 120, 130}}},
+		{"compacted descending", EventQuery{Compacted: true, Order: Descending, Until: 115}, [][]int64{{100, 110}}},
+		{"no match", EventQuery{Compacted: true, Since: 200}, [][]int64{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			matched, err := test.query.matchReadings(stored, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([][]int64, 0, len(matched))
+			for _, e := range matched {
+				got = append(got, creationTimes(e.Expand()))
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("matched %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestListEventsPagedCompacted(t *testing.T) {
+	cache := newTestCache(1000, EventStoreOptions{CompactRepeats: true})
+	data := map[string]interface{}{"motion": true}
+	for _, time := range []int64{100, 110, 120} {
+		cache.ingest(Event{DeviceId: "dev1", CreationTime: time, Data: data}, 200)
+	}
+	cache.ingest(Event{DeviceId: "dev2", CreationTime: 125, Data: data}, 200)
+
+	page, err := cache.ListEventsPaged("dev1", "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !page.HasNextPage || len(page.Edges) != 2 || page.Edges[0].Node.CreationTime != 100 || page.Edges[1].Node.CreationTime != 110 {
+		t.Fatalf("expected readings 100 and 110 with a next page, got %+v", page)
+	}
+	if page.Edges[0].Node.Repeats != nil {
+		t.Errorf("expected each reading to be paged by itself, got %+v", page.Edges[0].Node)
+	}
+
+	// A reading collapsed into the event after the cursor was handed out is still paged
+	cache.ingest(Event{DeviceId: "dev1", CreationTime: 130, Data: data}, 200)
+	page, err = cache.ListEventsPaged("dev1", page.EndCursor, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var times []int64
+	for _, edge := range page.Edges {
+		times = append(times, edge.Node.CreationTime)
+	}
+	if !reflect.DeepEqual(times, []int64{120, 130}) || page.HasNextPage {
+		t.Errorf("expected readings 120 and 130 on the last page, got %v", times)
+	}
+
+	// Pruning the oldest readings of the event does not repeat or skip readings
+	cursor := page.Edges[0].Cursor
+	cache.data[0] = trimReadings(cache.data[0], 115)
+	page, err = cache.ListEventsPaged("dev1", cursor, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Edges) != 1 || page.Edges[0].Node.CreationTime != 130 {
+		t.Errorf("expected reading 130 after pruning, got %+v", page.Edges)
+	}
+}
+
+func TestListEventsPagedInvalidCursor(t *testing.T) {
+	cache := newTestCache(1000, EventStoreOptions{})
+	if _, err := cache.ListEventsPaged("", "not a cursor", 10); err == nil {
+		t.Error("expected an error for an invalid cursor")
+	}
+}
@@ -0,0 +1,504 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQL differences between the supported databases
+type dbDialect struct {
+	driver string
+	// Column definition of the generated event id, which orders events with the same creation time
+	idColumn string
+	// Returns the placeholder for the n-th query argument, counting from 1
+	placeholder func(n int) string
+}
+
+var postgresDialect = dbDialect{
+	driver:      "postgres",
+	idColumn:    "BIGSERIAL PRIMARY KEY",
+	placeholder: func(n int) string { return fmt.Sprintf("$%d", n) },
+}
+
+var sqliteDialect = dbDialect{
+	driver:      "sqlite3",
+	idColumn:    "INTEGER PRIMARY KEY AUTOINCREMENT",
+	placeholder: func(n int) string { return "?" },
+}
+
+// Schema migrations, applied in order. The index of a migration plus one is its schema version.
+var dbMigrations = []func(d dbDialect) []string{
+	func(d dbDialect) []string {
+		return []string{
+			fmt.Sprintf("CREATE TABLE events (id %s, topic TEXT NOT NULL, device_id TEXT NOT NULL, creation_time BIGINT NOT NULL, data TEXT NOT NULL)", d.idColumn),
+			// Redelivered events are identified by device, topic and creation time
+			"CREATE UNIQUE INDEX events_device_reading ON events (device_id, creation_time, topic)",
+			"CREATE INDEX events_creation_time ON events (creation_time)",
+		}
+	},
+	func(d dbDialect) []string {
+		return []string{"ALTER TABLE events ADD COLUMN meta TEXT"}
+	},
+	func(d dbDialect) []string {
+		return []string{
+			// Distinct readings of a device can share a creation time, so redelivered events are
+			// identified by a hash of their data as well. Events stored before this version have no
+			// hash: NULLs never conflict, so a redelivery of one of them is stored again.
+			"ALTER TABLE events ADD COLUMN data_hash TEXT",
+			"DROP INDEX events_device_reading",
+			"CREATE UNIQUE INDEX events_device_reading ON events (device_id, creation_time, topic, data_hash)",
+		}
+	},
+}
+
+// Stores events in a SQL database, so that they are kept beyond the window of the event cache
+type dbEventStore struct {
+	db      *sql.DB
+	dialect dbDialect
+}
+
+// Open the database given by a postgres:// or sqlite:// URL, and migrate it to the current schema
+func NewDBEventStore(dbUrl string) (*dbEventStore, error) {
+	var dialect dbDialect
+	dsn := dbUrl
+	switch {
+	case strings.HasPrefix(dbUrl, "postgres://"), strings.HasPrefix(dbUrl, "postgresql://"):
+		dialect = postgresDialect
+	case strings.HasPrefix(dbUrl, "sqlite://"):
+		dialect = sqliteDialect
+		dsn = strings.TrimPrefix(dbUrl, "sqlite://")
+		// Let exports read while events are written, and wait for the write lock instead of failing
+		if !strings.Contains(dsn, "?") {
+			dsn += "?_journal_mode=WAL&_busy_timeout=5000"
+		}
+	default:
+		scheme := dbUrl
+		if i := strings.Index(dbUrl, ":"); i >= 0 {
+			scheme = dbUrl[:i]
+		}
+		return nil, fmt.Errorf("unsupported database scheme %q, expected postgres:// or sqlite://", scheme)
+	}
+	db, err := sql.Open(dialect.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	store := &dbEventStore{db: db, dialect: dialect}
+	err = store.migrate()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error migrating database schema: %v", err)
+	}
+	return store, nil
+}
+
+// Apply the migrations newer than the schema version of the database
+func (s *dbEventStore) migrate() error {
+	_, err := s.db.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)")
+	if err != nil {
+		return err
+	}
+	var version sql.NullInt64
+	err = s.db.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+	for i := int(version.Int64); i < len(dbMigrations); i++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		statements := append(dbMigrations[i](s.dialect), fmt.Sprintf("INSERT INTO schema_version (version) VALUES (%d)", i+1))
+		for _, statement := range statements {
+			_, err = tx.Exec(statement)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+		log.Printf("Migrated database schema to version %d", i+1)
+	}
+	return nil
+}
+
+func (s *dbEventStore) Close() error {
+	return s.db.Close()
+}
+
+// Check that the database can be reached, waiting at most 5 seconds
+func (s *dbEventStore) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	return s.db.PingContext(ctx)
+}
+
+// Returns Connected if the database can be reached
+func (s *dbEventStore) State() ConnectionState {
+	if s.Ping(context.Background()) != nil {
+		return Disconnected
+	}
+	return Connected
+}
+
+// Insert an event, ignoring events that were already stored. An event is already stored if one of
+// the same device, topic and creation time has the same data, as in the cache.
+func (s *dbEventStore) Add(event Event) error {
+	// Map keys are encoded sorted, so equal data has the same encoding
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(data)
+	var meta sql.NullString
+	if len(event.Meta) > 0 {
+		encoded, err := json.Marshal(event.Meta)
+		if err != nil {
+			return err
+		}
+		meta = sql.NullString{String: string(encoded), Valid: true}
+	}
+	p := s.dialect.placeholder
+	_, err = s.db.Exec(fmt.Sprintf("INSERT INTO events (topic, device_id, creation_time, data, meta, data_hash) VALUES (%s, %s, %s, %s, %s, %s) ON CONFLICT DO NOTHING", p(1), p(2), p(3), p(4), p(5), p(6)),
+		event.Topic, event.DeviceId, event.CreationTime, string(data), meta, hex.EncodeToString(hash[:]))
+	return err
+}
+
+// Delete the events created before the given time, returning the number of deleted events
+func (s *dbEventStore) Prune(before int64) (int64, error) {
+	result, err := s.db.Exec(fmt.Sprintf("DELETE FROM events WHERE creation_time < %s", s.dialect.placeholder(1)), before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Delete the events older than the retention every tenth of the retention, and at least every
+// minute, until the context is done
+func (s *dbEventStore) RunRetention(ctx context.Context, retention time.Duration) {
+	wait := retention / 10
+	if wait > time.Minute {
+		wait = time.Minute
+	}
+	if wait < time.Second {
+		wait = time.Second
+	}
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			_, err := s.Prune(time.Now().UTC().Add(-retention).Unix())
+			if err != nil {
+				log.Println("Error deleting events older than the retention:", err)
+			}
+		}
+	}
+}
+
+// Returns a LIKE pattern matching strings that start with the prefix, escaping the wildcards in it
+func likePrefix(prefix string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix) + "%"
+}
+
+// Returns the WHERE clause and arguments selecting the events of the query that can be matched in SQL
+func (s *dbEventStore) where(deviceId string, deviceIdPrefix string, topic string, since int64, until int64) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	// Add a condition with a %s for the placeholder of its argument
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, s.dialect.placeholder(len(args))))
+	}
+	if deviceId != "" {
+		add("device_id = %s", deviceId)
+	}
+	if deviceIdPrefix != "" {
+		add(`device_id LIKE %s ESCAPE '\'`, likePrefix(deviceIdPrefix))
+	}
+	if topic != "" {
+		add("topic = %s", topic)
+	}
+	if since > 0 {
+		add("creation_time >= %s", since)
+	}
+	if until > 0 {
+		add("creation_time <= %s", until)
+	}
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// Query events, calling fn for each event in the given order until fn returns false
+func (s *dbEventStore) query(where string, args []interface{}, order SortOrder, limit int, fn func(Event) (bool, error)) error {
+	direction := "ASC"
+	if order == Descending {
+		direction = "DESC"
+	}
+	query := fmt.Sprintf("SELECT topic, device_id, creation_time, data, meta FROM events%s ORDER BY creation_time %s, id %s", where, direction, direction)
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return err
+		}
+		more, err := fn(e)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Decode a row of the columns before, then topic, device_id, creation_time, data and meta
+func scanEvent(rows *sql.Rows, before ...interface{}) (Event, error) {
+	var e Event
+	var data string
+	var meta sql.NullString
+	err := rows.Scan(append(before, &e.Topic, &e.DeviceId, &e.CreationTime, &data, &meta)...)
+	if err != nil {
+		return e, err
+	}
+	err = decodeJSON([]byte(data), &e.Data)
+	if err == nil && meta.Valid {
+		err = decodeJSON([]byte(meta.String), &e.Meta)
+	}
+	if err != nil {
+		return e, fmt.Errorf("invalid data stored for event from %s at %d: %v", e.DeviceId, e.CreationTime, err)
+	}
+	return e, nil
+}
+
+// Collect up to max matching events, counting all matches if count is set. Filters on the event
+// data and device checks are applied to the rows, the other criteria in SQL.
+func (s *dbEventStore) scanEvents(query EventQuery, count bool) ([]Event, int, error) {
+	err := query.Validate()
+	if err != nil {
+		return nil, 0, err
+	}
+	where, args := s.where(query.DeviceId, query.DeviceIdPrefix, query.Topic, query.Since, query.Until)
+	// LIKE ignores case in SQLite, so the device id prefix is checked on the rows as well
+	filtered := query.Filter != nil || query.DeviceAllowed != nil || query.DeviceIdPrefix != ""
+
+	limit := 0
+	if !filtered {
+		limit = query.Max
+	}
+	ret := make([]Event, 0)
+	numValues := 0
+	err = s.query(where, args, query.Order, limit, func(e Event) (bool, error) {
+		match, err := query.matches(e)
+		if err != nil || !match {
+			return err == nil, err
+		}
+		numValues++
+		if query.Max <= 0 || len(ret) < query.Max {
+			ret = append(ret, e)
+		}
+		return count || query.Max <= 0 || numValues < query.Max, nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if count && !filtered && query.Max > 0 && len(ret) == query.Max {
+		err = s.db.QueryRow("SELECT COUNT(*) FROM events"+where, args...).Scan(&numValues)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return ret, numValues, nil
+}
+
+// List the events matching the query
+func (s *dbEventStore) ListEvents(query EventQuery) ([]Event, error) {
+	events, _, err := s.scanEvents(query, false)
+	return events, err
+}
+
+// List the events matching the query, along with the number of events matching before max is applied
+func (s *dbEventStore) ListEventsCounted(query EventQuery) (EventList, error) {
+	events, total, err := s.scanEvents(query, true)
+	if err != nil {
+		return EventList{}, err
+	}
+	return EventList{TotalCount: total, Events: events}, nil
+}
+
+// Returns the newest event for the given device, or nil if there is none
+func (s *dbEventStore) LatestEvent(deviceId string) (*Event, error) {
+	events, err := s.ListEvents(EventQuery{DeviceId: deviceId, Order: Descending, Max: 1})
+	if err != nil || len(events) == 0 {
+		return nil, err
+	}
+	return &events[0], nil
+}
+
+// Call fn for each event matching the query, oldest first, reading the rows as fn consumes them
+func (s *dbEventStore) StreamEvents(query EventQuery, fn func(Event) error) error {
+	err := query.Validate()
+	if err != nil {
+		return err
+	}
+	if query.Order == Descending {
+		return fmt.Errorf("events can only be streamed in ascending order")
+	}
+	where, args := s.where(query.DeviceId, query.DeviceIdPrefix, query.Topic, query.Since, query.Until)
+	numValues := 0
+	return s.query(where, args, Ascending, 0, func(e Event) (bool, error) {
+		match, err := query.matches(e)
+		if err != nil || !match {
+			return err == nil, err
+		}
+		err = fn(e)
+		if err != nil {
+			return false, err
+		}
+		numValues++
+		return query.Max <= 0 || numValues < query.Max, nil
+	})
+}
+
+// Compute statistics for a numeric field over the events of a device. An until of 0 means no upper bound.
+func (s *dbEventStore) EventStats(deviceId string, field string, since int64, until int64) (EventStats, error) {
+	err := validateField(field)
+	if err != nil {
+		return EventStats{}, err
+	}
+	where, args := s.where(deviceId, "", "", since, until)
+	var acc statsAccumulator
+	err = s.query(where, args, Ascending, 0, func(e Event) (bool, error) {
+		return true, acc.add(e, field)
+	})
+	if err != nil {
+		return EventStats{}, err
+	}
+	return acc.stats(), nil
+}
+
+// Aggregate a numeric field over the events of a device into fixed size time buckets
+func (s *dbEventStore) EventSeries(query SeriesQuery) ([]SeriesPoint, error) {
+	acc, err := newSeriesAccumulator(query)
+	if err != nil {
+		return nil, err
+	}
+	where, args := s.where(query.DeviceId, "", "", query.Since, query.Until)
+	err = s.query(where, args, Ascending, 0, func(e Event) (bool, error) {
+		return true, acc.add(e)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return acc.points()
+}
+
+// Returns a page of up to max events stored after the cursor, in the order they were stored. The
+// cursor holds the id of the last event of the previous page.
+func (s *dbEventStore) ListEventsPaged(deviceId string, after string, max int) (EventPage, error) {
+	page := EventPage{Edges: make([]EventEdge, 0)}
+	where, args := s.where(deviceId, "", "", 0, 0)
+	if after != "" {
+		_, id, _, err := decodeCursor(after)
+		if err != nil {
+			return page, err
+		}
+		args = append(args, id)
+		condition := fmt.Sprintf("id > %s", s.dialect.placeholder(len(args)))
+		if where == "" {
+			where = " WHERE " + condition
+		} else {
+			where += " AND " + condition
+		}
+	}
+	query := "SELECT id, topic, device_id, creation_time, data, meta FROM events" + where + " ORDER BY id"
+	// One more event than requested tells if there is a next page
+	if max > 0 {
+		query += fmt.Sprintf(" LIMIT %d", max+1)
+	}
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		e, err := scanEvent(rows, &id)
+		if err != nil {
+			return page, err
+		}
+		if max > 0 && len(page.Edges) >= max {
+			page.HasNextPage = true
+			break
+		}
+		page.Edges = append(page.Edges, EventEdge{Cursor: encodeCursor(e.CreationTime, id, 0), Node: e})
+	}
+	if err = rows.Err(); err != nil {
+		return page, err
+	}
+	if len(page.Edges) > 0 {
+		page.EndCursor = page.Edges[len(page.Edges)-1].Cursor
+	}
+	return page, nil
+}
+
+// Returns the newest event of each of the devices, or of all devices with stored events ordered by
+// device id if ids is empty. Devices without events are left out.
+func (s *dbEventStore) LatestPerDevice(ids []string) ([]Event, error) {
+	if len(ids) == 0 {
+		rows, err := s.db.Query("SELECT DISTINCT device_id FROM events ORDER BY device_id")
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var deviceId string
+			if err := rows.Scan(&deviceId); err != nil {
+				return nil, err
+			}
+			ids = append(ids, deviceId)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	latest := make([]Event, 0, len(ids))
+	for _, deviceId := range ids {
+		if deviceId == "" {
+			continue
+		}
+		e, err := s.LatestEvent(deviceId)
+		if err != nil {
+			return nil, err
+		}
+		if e != nil {
+			latest = append(latest, *e)
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,282 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func newTestDB(t *testing.T) *dbEventStore {
+	t.Helper()
+	store, err := NewDBEventStore("sqlite://" + filepath.Join(t.TempDir(), "events.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// Returns an event of the device with the given temperature
+func dbTestEvent(deviceId string, creationTime int64, temperature string) Event {
+	return Event{DeviceId: deviceId, CreationTime: creationTime, Topic: "events", Data: map[string]interface{}{"temperature": json.Number(temperature)}}
+}
+
+func addTestEvents(t *testing.T, store *dbEventStore, events ...Event) {
+	t.Helper()
+	for _, e := range events {
+		if err := store.Add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func schemaVersion(t *testing.T, store *dbEventStore) int {
+	t.Helper()
+	var version int
+	err := store.db.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+func TestDBMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.db")
+	// A database at schema version 2, with an event stored before data hashes
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statements := []string{"CREATE TABLE schema_version (version INTEGER NOT NULL)"}
+	for i := 0; i < 2; i++ {
+		statements = append(statements, dbMigrations[i](sqliteDialect)...)
+	}
+	statements = append(statements,
+		"INSERT INTO schema_version (version) VALUES (1), (2)",
+		`INSERT INTO events (topic, device_id, creation_time, data) VALUES ('events', 'dev1', 100, '{"temperature":20}')`)
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	store, err := NewDBEventStore("sqlite://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := schemaVersion(t, store); got != len(dbMigrations) {
+		t.Errorf("migrated to version %d, want %d", got, len(dbMigrations))
+	}
+	addTestEvents(t, store, dbTestEvent("dev1", 100, "21"))
+	store.Close()
+
+	// Reopening leaves the schema and the events as they are
+	store, err = NewDBEventStore("sqlite://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	var versions int
+	if err := store.db.QueryRow("SELECT COUNT(*) FROM schema_version").Scan(&versions); err != nil {
+		t.Fatal(err)
+	}
+	if versions != len(dbMigrations) {
+		t.Errorf("schema_version has %d rows, want %d", versions, len(dbMigrations))
+	}
+	events, err := store.ListEvents(EventQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Event{dbTestEvent("dev1", 100, "20"), dbTestEvent("dev1", 100, "21")}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("got events %v, want %v", events, want)
+	}
+}
+
+func TestDBAddDuplicate(t *testing.T) {
+	store := newTestDB(t)
+	addTestEvents(t, store,
+		dbTestEvent("dev1", 100, "20"),
+		// Redelivered
+		dbTestEvent("dev1", 100, "20"),
+		// Distinct readings in the same second
+		dbTestEvent("dev1", 100, "21"),
+		Event{DeviceId: "dev1", CreationTime: 100, Topic: "events", Data: map[string]interface{}{"humidity": json.Number("40")}},
+		// Same data on another topic
+		Event{DeviceId: "dev1", CreationTime: 100, Topic: "other", Data: map[string]interface{}{"temperature": json.Number("20")}},
+	)
+	list, err := store.ListEventsCounted(EventQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.TotalCount != 4 {
+		t.Errorf("stored %d events, want 4: %v", list.TotalCount, list.Events)
+	}
+}
+
+func TestDBListEvents(t *testing.T) {
+	store := newTestDB(t)
+	addTestEvents(t, store,
+		dbTestEvent("zone1/dev1", 100, "20"),
+		dbTestEvent("zone1/dev2", 110, "21"),
+		dbTestEvent("zone2/dev1", 120, "22"),
+		dbTestEvent("zone1/dev1", 130, "23"),
+		dbTestEvent("zone1_dev3", 140, "24"),
+	)
+	tests := []struct {
+		name  string
+		query EventQuery
+		want  []int64
+	}{
+		{"all", EventQuery{}, []int64{100, 110, 120, 130, 140}},
+		{"device", EventQuery{DeviceId: "zone1/dev1"}, []int64{100, 130}},
+		// The _ in the prefix is not a wildcard
+		{"prefix", EventQuery{DeviceIdPrefix: "zone1/"}, []int64{100, 110, 130}},
+		{"since", EventQuery{Since: 120}, []int64{120, 130, 140}},
+		{"until", EventQuery{Until: 110}, []int64{100, 110}},
+		{"descending", EventQuery{Order: Descending, Max: 2}, []int64{140, 130}},
+		{"max", EventQuery{Max: 2}, []int64{100, 110}},
+		{"allowed", EventQuery{DeviceAllowed: func(deviceId string) bool { return deviceId == "zone2/dev1" }}, []int64{120}},
+		{"topic", EventQuery{Topic: "other"}, []int64{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			events, err := store.ListEvents(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := creationTimes(events); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got events at %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	list, err := store.ListEventsCounted(EventQuery{DeviceIdPrefix: "zone1/", Max: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.TotalCount != 3 || len(list.Events) != 1 {
+		t.Errorf("got %d of %d events, want 1 of 3", len(list.Events), list.TotalCount)
+	}
+	list, err = store.ListEventsCounted(EventQuery{Since: 110, Max: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.TotalCount != 4 || len(list.Events) != 2 {
+		t.Errorf("got %d of %d events, want 2 of 4", len(list.Events), list.TotalCount)
+	}
+}
+
+func TestDBListEventsPaged(t *testing.T) {
+	store := newTestDB(t)
+	addTestEvents(t, store,
+		dbTestEvent("dev1", 130, "20"),
+		dbTestEvent("dev2", 100, "21"),
+		dbTestEvent("dev1", 110, "22"),
+		dbTestEvent("dev1", 120, "23"),
+	)
+	// Events are paged in the order they were stored
+	var got []int64
+	after := ""
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("too many pages")
+		}
+		page, err := store.ListEventsPaged("dev1", after, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, edge := range page.Edges {
+			got = append(got, edge.Node.CreationTime)
+		}
+		if !page.HasNextPage {
+			break
+		}
+		after = page.EndCursor
+	}
+	if want := []int64{130, 110, 120}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got events at %v, want %v", got, want)
+	}
+}
+
+func TestDBLatestPerDevice(t *testing.T) {
+	store := newTestDB(t)
+	addTestEvents(t, store,
+		dbTestEvent("dev2", 100, "20"),
+		dbTestEvent("dev1", 120, "21"),
+		dbTestEvent("dev1", 110, "22"),
+	)
+	latest, err := store.LatestPerDevice(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Event{dbTestEvent("dev1", 120, "21"), dbTestEvent("dev2", 100, "20")}
+	if !reflect.DeepEqual(latest, want) {
+		t.Errorf("got latest events %v, want %v", latest, want)
+	}
+	latest, err = store.LatestPerDevice([]string{"dev2", "dev3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(latest, want[1:]) {
+		t.Errorf("got latest events %v, want %v", latest, want[1:])
+	}
+}
+
+func TestDBStatsAndSeries(t *testing.T) {
+	store := newTestDB(t)
+	addTestEvents(t, store,
+		dbTestEvent("dev1", 100, "20"),
+		dbTestEvent("dev1", 105, "22"),
+		dbTestEvent("dev1", 110, "30"),
+		dbTestEvent("dev2", 105, "50"),
+	)
+	stats, err := store.EventStats("dev1", "temperature", 0, 105)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Count != 2 || *stats.Min != 20 || *stats.Max != 22 || *stats.Last != 22 {
+		t.Errorf("got stats %+v, want 2 events from 20 to 22", stats)
+	}
+	points, err := store.EventSeries(SeriesQuery{DeviceId: "dev1", Field: "temperature", Since: 100, BucketSeconds: 10, Aggregation: AggregateAvg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]float64, 0, len(points))
+	for _, point := range points {
+		got = append(got, *point.Value)
+	}
+	if want := []float64{21, 30}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got series %v, want %v", got, want)
+	}
+}
+
+func TestDBPrune(t *testing.T) {
+	store := newTestDB(t)
+	addTestEvents(t, store,
+		dbTestEvent("dev1", 100, "20"),
+		dbTestEvent("dev2", 110, "21"),
+		dbTestEvent("dev1", 120, "22"),
+	)
+	deleted, err := store.Prune(120)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 2 {
+		t.Errorf("deleted %d events, want 2", deleted)
+	}
+	events, err := store.ListEvents(EventQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := creationTimes(events); !reflect.DeepEqual(got, []int64{120}) {
+		t.Errorf("kept events at %v, want [120]", got)
+	}
+}
@@ -5,9 +5,18 @@
 package api
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type deviceRegistryResponse struct {
@@ -19,35 +28,247 @@ type deviceRegistry struct {
 	url      string
 	username string
 	password string
+	source   string
+}
+
+const (
+	registryAttempts     = 3
+	registryRetryBackoff = 500 * time.Millisecond
+	// Max number of body bytes included in error messages
+	maxErrorBody = 256
+)
+
+// Options for the HTTP client used to talk to the device registry
+type DeviceRegistryOptions struct {
+	// Timeout of a single request, including reading the response
+	Timeout time.Duration
+	// Max number of idle connections kept open to the registry, 0 uses the net/http default
+	MaxIdleConnsPerHost int
+	// How long an idle connection is kept open, 0 means no limit
+	IdleConnTimeout   time.Duration
+	DisableKeepAlives bool
+	// Name set as the source of devices listed by the registry
+	Source string
 }
 
-func NewDeviceRegistryClient(url string, username string, password string) *deviceRegistry {
+func NewDeviceRegistryClient(url string, username string, password string, options DeviceRegistryOptions) *deviceRegistry {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = options.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = options.IdleConnTimeout
+	transport.DisableKeepAlives = options.DisableKeepAlives
 	return &deviceRegistry{
-		client:   &http.Client{},
+		client: &http.Client{
+			Timeout:   options.Timeout,
+			Transport: transport,
+		},
 		url:      url,
 		username: username,
 		password: password,
+		source:   options.Source,
 	}
 }
 
-func (d *deviceRegistry) ListDevices() ([]Device, error) {
-	req, err := http.NewRequest("GET", d.url, nil)
+// Perform a registry request, retrying on network errors and server errors
+func (d *deviceRegistry) do(req *http.Request) (*http.Response, error) {
+	backoff := registryRetryBackoff
+	for attempt := 1; ; attempt++ {
+		resp, err := d.doOnce(req)
+		if err == nil && resp.StatusCode < 500 {
+			return resp, nil
+		}
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("device registry returned %s", resp.Status)
+		}
+		if attempt >= registryAttempts {
+			return nil, fmt.Errorf("%s %s failed after %d attempts: %v", req.Method, req.URL, attempt, err)
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if req.GetBody != nil {
+			req.Body, err = req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// Perform a single registry request, recording its latency and outcome
+func (d *deviceRegistry) doOnce(req *http.Request) (*http.Response, error) {
+	// Let the registry continue the trace of the request
+	otel.GetTextMapPropagator().Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+	start := time.Now()
+	resp, err := d.client.Do(req)
+	registryRequestDuration.Observe(time.Since(start).Seconds())
+	if err != nil || resp.StatusCode >= 400 {
+		registryRequestErrors.Inc()
+	}
+	return resp, err
+}
+
+type authorizationKey struct{}
+
+// Returns a context for registry requests made on behalf of a caller, which are sent with the
+// caller's Authorization header instead of the configured credentials
+func WithAuthorization(ctx context.Context, authorization string) context.Context {
+	return context.WithValue(ctx, authorizationKey{}, authorization)
+}
+
+// Set the Authorization header of the request context, or the configured credentials
+func (d *deviceRegistry) authorize(req *http.Request) {
+	if authorization, ok := req.Context().Value(authorizationKey{}).(string); ok && authorization != "" {
+		req.Header.Set("Authorization", authorization)
+		return
+	}
+	req.SetBasicAuth(d.username, d.password)
+}
+
+func (d *deviceRegistry) ListDevices(ctx context.Context) (devices []Device, err error) {
+	ctx, span := tracer.Start(ctx, "ListDevices", trace.WithAttributes(attribute.String("registry", d.source)))
+	defer func() { endSpan(span, err) }()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", d.url, nil)
 	if err != nil {
 		return nil, err
 	}
-	req.SetBasicAuth(d.username, d.password)
+	d.authorize(req)
 
-	resp, err := d.client.Do(req)
+	resp, err := d.do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading device list from %s: %v", d.url, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("error listing devices from %s: %s: %s", d.url, resp.Status, truncateBody(body))
+	}
 
 	var result deviceRegistryResponse
 	err = json.Unmarshal(body, &result)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("error decoding device list from %s: %v: %s", d.url, err, truncateBody(body))
+	}
+	for i := range result.Devices {
+		result.Devices[i].Source = d.source
 	}
 	return result.Devices, nil
 }
+
+// Check that the registry is reachable and accepts the credentials, without listing the devices.
+// Sends a HEAD request for the device list, or a GET whose body is not read if the registry does
+// not support HEAD. The request is not retried.
+func (d *deviceRegistry) Ping(ctx context.Context) (err error) {
+	ctx, span := tracer.Start(ctx, "Ping", trace.WithAttributes(attribute.String("registry", d.source)))
+	defer func() { endSpan(span, err) }()
+
+	status, err := d.ping(ctx, "HEAD")
+	if err == nil && (status == http.StatusMethodNotAllowed || status == http.StatusNotImplemented) {
+		status, err = d.ping(ctx, "GET")
+	}
+	if err != nil {
+		return fmt.Errorf("error reaching device registry %s: %v", d.url, err)
+	}
+	if status < 200 || status >= 300 {
+		return fmt.Errorf("device registry %s returned %d %s", d.url, status, http.StatusText(status))
+	}
+	return nil
+}
+
+// Send a single request for the device list, and return the status of the response
+func (d *deviceRegistry) ping(ctx context.Context, method string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, d.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	d.authorize(req)
+	resp, err := d.doOnce(req)
+	if err != nil {
+		return 0, err
+	}
+	// The body of a GET is not needed, so it is closed without being read
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// Returns a response body suitable for including in an error message
+func truncateBody(body []byte) string {
+	if len(body) == 0 {
+		return "empty body"
+	}
+	if len(body) > maxErrorBody {
+		return string(body[:maxErrorBody]) + "..."
+	}
+	return string(body)
+}
+
+// Returns the device with the given id, or nil if the registry does not know it
+func (d *deviceRegistry) GetDevice(ctx context.Context, id string) (*Device, error) {
+	devices, err := d.ListDevices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, device := range devices {
+		if device.ID == id {
+			return &device, nil
+		}
+	}
+	return nil, nil
+}
+
+func (d *deviceRegistry) SetEnabled(ctx context.Context, id string, enabled bool) (Device, error) {
+	return d.patch(ctx, id, map[string]bool{"enabled": enabled})
+}
+
+// Update the given fields of the device, fields that are nil are left unchanged
+func (d *deviceRegistry) Update(ctx context.Context, id string, patch DevicePatch) (Device, error) {
+	return d.patch(ctx, id, patch)
+}
+
+// Send a PATCH request for the device, and return the updated device
+func (d *deviceRegistry) patch(ctx context.Context, id string, fields interface{}) (Device, error) {
+	var device Device
+	payload, err := json.Marshal(fields)
+	if err != nil {
+		return device, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "PATCH", d.url+"/"+id, bytes.NewReader(payload))
+	if err != nil {
+		return device, err
+	}
+	d.authorize(req)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := d.do(req)
+	if err != nil {
+		return device, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return device, err
+	}
+	// The registry rejected the update, its response usually says why
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnprocessableEntity {
+		return device, fmt.Errorf("invalid update for device %s: %s", id, truncateBody(body))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return device, fmt.Errorf("error updating device %s: %s: %s", id, resp.Status, truncateBody(body))
+	}
+
+	err = json.Unmarshal(body, &device)
+	if err != nil {
+		return device, err
+	}
+	device.Source = d.source
+	return device, nil
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package api
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+type DeviceChangeType string
+
+const (
+	DeviceAdded          DeviceChangeType = "added"
+	DeviceRemoved        DeviceChangeType = "removed"
+	DeviceEnabledChanged DeviceChangeType = "enabledChanged"
+)
+
+// A change to a device in the registry. Previous is nil for added devices, Current is nil for removed devices.
+type DeviceChange struct {
+	Type     DeviceChangeType `json:"type"`
+	Previous *Device          `json:"previous"`
+	Current  *Device          `json:"current"`
+}
+
+// Number of changes buffered for each subscriber before changes are dropped
+const subscriberBuffer = 64
+
+// Polls the device registry and notifies subscribers of changes between polls
+type deviceWatcher struct {
+	fetch       func(context.Context) ([]Device, error)
+	interval    time.Duration
+	mutex       sync.Mutex
+	subscribers map[chan DeviceChange]bool
+}
+
+func NewDeviceWatcher(fetch func(context.Context) ([]Device, error), interval time.Duration) *deviceWatcher {
+	return &deviceWatcher{
+		fetch:       fetch,
+		interval:    interval,
+		subscribers: make(map[chan DeviceChange]bool),
+	}
+}
+
+// Returns the changes between two device lists, keyed on device id and ordered by id
+func DiffDevices(previous []Device, current []Device) []DeviceChange {
+	before := make(map[string]Device)
+	for _, device := range previous {
+		before[device.ID] = device
+	}
+	after := make(map[string]Device)
+	for _, device := range current {
+		after[device.ID] = device
+	}
+
+	changes := make([]DeviceChange, 0)
+	for id, device := range after {
+		device := device
+		old, ok := before[id]
+		if !ok {
+			changes = append(changes, DeviceChange{Type: DeviceAdded, Current: &device})
+		} else if old.Enabled != device.Enabled {
+			changes = append(changes, DeviceChange{Type: DeviceEnabledChanged, Previous: &old, Current: &device})
+		}
+	}
+	for id, device := range before {
+		device := device
+		if _, ok := after[id]; !ok {
+			changes = append(changes, DeviceChange{Type: DeviceRemoved, Previous: &device})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changeId(changes[i]) < changeId(changes[j]) })
+	return changes
+}
+
+func changeId(change DeviceChange) string {
+	if change.Current != nil {
+		return change.Current.ID
+	}
+	return change.Previous.ID
+}
+
+// Poll the registry until the context is done. The first successful poll is the baseline, and does not produce changes.
+func (w *deviceWatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	var previous []Device
+	polled := false
+	for {
+		devices, err := w.fetch(ctx)
+		if err != nil {
+			log.Println("Error polling device registry:", err)
+		} else {
+			if polled {
+				for _, change := range DiffDevices(previous, devices) {
+					w.publish(change)
+				}
+			}
+			previous = devices
+			polled = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Register for device changes. The returned function must be called to unregister.
+func (w *deviceWatcher) Subscribe() (<-chan DeviceChange, func()) {
+	ch := make(chan DeviceChange, subscriberBuffer)
+	w.mutex.Lock()
+	w.subscribers[ch] = true
+	w.mutex.Unlock()
+	return ch, func() {
+		w.mutex.Lock()
+		delete(w.subscribers, ch)
+		w.mutex.Unlock()
+	}
+}
+
+// Send a change to all subscribers, dropping it for subscribers that are not keeping up
+func (w *deviceWatcher) publish(change DeviceChange) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for ch := range w.subscribers {
+		select {
+		case ch <- change:
+		default:
+			log.Println("Dropping device change for slow subscriber")
+		}
+	}
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package api
+
+import (
+	"sort"
+	"strings"
+)
+
+// Label assigning a device to a group
+const GroupLabel = "group"
+
+// Criteria for filtering devices. Empty fields do not restrict the result.
+type DeviceFilter struct {
+	// Case-insensitive substring of the device name
+	NameContains string
+	HasSensor    string
+	Enabled      *bool
+	// Labels the device must have, with the given values
+	Labels map[string]string
+}
+
+func (f DeviceFilter) matches(device Device) bool {
+	if f.NameContains != "" && !strings.Contains(strings.ToLower(device.Name), strings.ToLower(f.NameContains)) {
+		return false
+	}
+	if f.Enabled != nil && device.Enabled != *f.Enabled {
+		return false
+	}
+	for key, value := range f.Labels {
+		if v, ok := device.Labels[key]; !ok || v != value {
+			return false
+		}
+	}
+	if f.HasSensor != "" {
+		for _, sensor := range device.Sensors {
+			if strings.EqualFold(sensor, f.HasSensor) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Returns the devices matching the filter
+func FilterDevices(devices []Device, filter DeviceFilter) []Device {
+	ret := make([]Device, 0)
+	for _, device := range devices {
+		if filter.matches(device) {
+			ret = append(ret, device)
+		}
+	}
+	return ret
+}
+
+// Returns the ids of the devices in the group
+func GroupDeviceIds(devices []Device, group string) []string {
+	ids := make([]string, 0)
+	for _, device := range FilterDevices(devices, DeviceFilter{Labels: map[string]string{GroupLabel: group}}) {
+		ids = append(ids, device.ID)
+	}
+	return ids
+}
+
+// Merge event lists by creation time in the given order, keeping at most max events. A max of 0 keeps all events.
+func MergeEvents(lists [][]Event, order SortOrder, max int) []Event {
+	ret := make([]Event, 0)
+	for _, events := range lists {
+		ret = append(ret, events...)
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		if order == Descending {
+			return ret[i].CreationTime > ret[j].CreationTime
+		}
+		return ret[i].CreationTime < ret[j].CreationTime
+	})
+	if max > 0 && len(ret) > max {
+		ret = ret[:max]
+	}
+	return ret
+}
+
+// Returns up to first devices starting at offset. A first of 0 returns all remaining devices.
+func PageDevices(devices []Device, first int, offset int) []Device {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset >= len(devices) {
+		return []Device{}
+	}
+	devices = devices[offset:]
+	if first > 0 && first < len(devices) {
+		devices = devices[:first]
+	}
+	return devices
+}
+
+// Returns the devices without events since the threshold, including devices that never sent an event
+func StaleDevices(devices []Device, lastSeen map[string]int64, threshold int64) []Device {
+	ret := make([]Device, 0)
+	for _, device := range devices {
+		if t, ok := lastSeen[device.ID]; !ok || t < threshold {
+			ret = append(ret, device)
+		}
+	}
+	return ret
+}
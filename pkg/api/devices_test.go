@@ -0,0 +1,74 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package api
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Returns the ids of the devices
+func deviceIds(devices []Device) []string {
+	ids := make([]string, 0, len(devices))
+	for _, device := range devices {
+		ids = append(ids, device.ID)
+	}
+	return ids
+}
+
+func TestFilterDevices(t *testing.T) {
+	enabled, disabled := true, false
+	devices := []Device{
+		{ID: "a", Name: "Greenhouse North", Enabled: true, Sensors: []string{"soil", "temperature"}},
+		{ID: "b", Name: "greenhouse south", Sensors: []string{"Soil"}},
+		{ID: "c", Name: "Shed", Enabled: true, Sensors: []string{"motion"}, Labels: map[string]string{GroupLabel: "outdoor"}},
+		{ID: "d"},
+	}
+	tests := []struct {
+		name   string
+		filter DeviceFilter
+		want   []string
+	}{
+		{"no filter", DeviceFilter{}, []string{"a", "b", "c", "d"}},
+		{"name ignores case", DeviceFilter{NameContains: "GREENHOUSE"}, []string{"a", "b"}},
+		{"name substring", DeviceFilter{NameContains: "south"}, []string{"b"}},
+		{"sensor ignores case", DeviceFilter{HasSensor: "soil"}, []string{"a", "b"}},
+		{"unknown sensor", DeviceFilter{HasSensor: "co2"}, []string{}},
+		{"enabled", DeviceFilter{Enabled: &enabled}, []string{"a", "c"}},
+		{"disabled", DeviceFilter{Enabled: &disabled}, []string{"b", "d"}},
+		{"combined", DeviceFilter{NameContains: "greenhouse", HasSensor: "soil", Enabled: &disabled}, []string{"b"}},
+		{"label", DeviceFilter{Labels: map[string]string{GroupLabel: "outdoor"}}, []string{"c"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := deviceIds(FilterDevices(devices, test.filter))
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPageDevices(t *testing.T) {
+	devices := []Device{{ID: "a"}, {ID: "b"}, {ID: "c"}}
+	tests := []struct {
+		first  int
+		offset int
+		want   []string
+	}{
+		{0, 0, []string{"a", "b", "c"}},
+		{2, 0, []string{"a", "b"}},
+		{2, 2, []string{"c"}},
+		{0, 1, []string{"b", "c"}},
+		{1, 5, []string{}},
+		{1, -1, []string{"a"}},
+	}
+	for _, test := range tests {
+		got := deviceIds(PageDevices(devices, test.first, test.offset))
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("PageDevices(first: %d, offset: %d) = %v, want %v", test.first, test.offset, got, test.want)
+		}
+	}
+}
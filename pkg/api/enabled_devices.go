@@ -0,0 +1,158 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package api
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// The set of devices enabled in the registry, refreshed by polling so that queries do not call the registry
+type enabledDevices struct {
+	fetch    func(context.Context) ([]Device, error)
+	interval time.Duration
+	mutex    sync.RWMutex
+	enabled  map[string]bool
+}
+
+func NewEnabledDevices(fetch func(context.Context) ([]Device, error), interval time.Duration) *enabledDevices {
+	return &enabledDevices{
+		fetch:    fetch,
+		interval: interval,
+	}
+}
+
+// Refresh the set until the context is done. The last set is kept when a refresh fails.
+func (d *enabledDevices) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		devices, err := d.fetch(ctx)
+		if err != nil {
+			log.Println("Error refreshing enabled devices:", err)
+		} else {
+			enabled := make(map[string]bool)
+			for _, device := range devices {
+				if device.Enabled {
+					enabled[device.ID] = true
+				}
+			}
+			d.mutex.Lock()
+			d.enabled = enabled
+			d.mutex.Unlock()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Returns true if the device is known to the registry and enabled. All devices are accepted until the
+// set has been fetched once, so that events are not hidden while the registry is unreachable at startup.
+func (d *enabledDevices) Enabled(deviceId string) bool {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.enabled == nil || d.enabled[deviceId]
+}
+
+// Restrict the query to enabled devices, unless it includes disabled devices
+func (d *enabledDevices) Restrict(query EventQuery) EventQuery {
+	if !query.IncludeDisabled {
+		query.DeviceAllowed = d.Enabled
+	}
+	return query
+}
+
+// Returns the store with its event queries restricted to enabled devices
+func (d *enabledDevices) RestrictStore(store EventStore) EventStore {
+	return restrictedEventStore{EventStore: store, enabled: d}
+}
+
+// An event store that leaves out the events of disabled devices. Event queries include them when
+// they ask for disabled devices.
+type restrictedEventStore struct {
+	EventStore
+	enabled *enabledDevices
+}
+
+func (s restrictedEventStore) ListEvents(query EventQuery) ([]Event, error) {
+	return s.EventStore.ListEvents(s.enabled.Restrict(query))
+}
+
+func (s restrictedEventStore) ListEventsCounted(query EventQuery) (EventList, error) {
+	return s.EventStore.ListEventsCounted(s.enabled.Restrict(query))
+}
+
+// Leaves out the newest events of disabled devices
+func (s restrictedEventStore) LatestPerDevice(ids []string) ([]Event, error) {
+	latest, err := s.EventStore.LatestPerDevice(ids)
+	if err != nil {
+		return nil, err
+	}
+	enabled := make([]Event, 0, len(latest))
+	for _, e := range latest {
+		if s.enabled.Enabled(e.DeviceId) {
+			enabled = append(enabled, e)
+		}
+	}
+	return enabled, nil
+}
+
+func (s restrictedEventStore) StreamEvents(query EventQuery, fn func(Event) error) error {
+	return s.EventStore.StreamEvents(s.enabled.Restrict(query), fn)
+}
+
+// Returns nil for a disabled device
+func (s restrictedEventStore) LatestEvent(deviceId string) (*Event, error) {
+	if !s.enabled.Enabled(deviceId) {
+		return nil, nil
+	}
+	return s.EventStore.LatestEvent(deviceId)
+}
+
+// Leaves out the events of disabled devices from the page, so a page may hold fewer than max events.
+// The cursor of the page is kept, so paging continues after the events that were left out.
+func (s restrictedEventStore) ListEventsPaged(deviceId string, after string, max int) (EventPage, error) {
+	if deviceId != "" && !s.enabled.Enabled(deviceId) {
+		return EventPage{Edges: make([]EventEdge, 0)}, nil
+	}
+	page, err := s.EventStore.ListEventsPaged(deviceId, after, max)
+	if err != nil {
+		return page, err
+	}
+	edges := make([]EventEdge, 0, len(page.Edges))
+	for _, edge := range page.Edges {
+		if s.enabled.Enabled(edge.Node.DeviceId) {
+			edges = append(edges, edge)
+		}
+	}
+	page.Edges = edges
+	return page, nil
+}
+
+// Returns the statistics of a device without events for a disabled device
+func (s restrictedEventStore) EventStats(deviceId string, field string, since int64, until int64) (EventStats, error) {
+	if !s.enabled.Enabled(deviceId) {
+		return EventStats{}, validateField(field)
+	}
+	return s.EventStore.EventStats(deviceId, field, since, until)
+}
+
+// Returns the series of a device without events for a disabled device
+func (s restrictedEventStore) EventSeries(query SeriesQuery) ([]SeriesPoint, error) {
+	if !s.enabled.Enabled(query.DeviceId) {
+		acc, err := newSeriesAccumulator(query)
+		if err != nil {
+			return nil, err
+		}
+		return acc.points()
+	}
+	return s.EventStore.EventSeries(query)
+}
@@ -0,0 +1,200 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package api
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Returns the device ids of the events
+func eventDeviceIds(events []Event) []string {
+	ids := make([]string, 0, len(events))
+	for _, e := range events {
+		ids = append(ids, e.DeviceId)
+	}
+	return ids
+}
+
+func TestRestrictStore(t *testing.T) {
+	cache := newTestCache(1000, EventStoreOptions{})
+	for _, deviceId := range []string{"a", "b", "c"} {
+		cache.store(Event{DeviceId: deviceId, CreationTime: 100})
+	}
+	enabled := NewEnabledDevices(nil, 0)
+	store := enabled.RestrictStore(cache)
+
+	// All devices are accepted until the enabled devices are fetched
+	latest, err := store.LatestPerDevice(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := eventDeviceIds(latest); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("expected the events of all devices, got %v", got)
+	}
+
+	enabled.enabled = map[string]bool{"a": true, "c": true}
+	events, err := store.ListEvents(EventQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := eventDeviceIds(events); !reflect.DeepEqual(got, []string{"a", "c"}) {
+		t.Errorf("expected the events of enabled devices, got %v", got)
+	}
+	events, err = store.ListEvents(EventQuery{IncludeDisabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := eventDeviceIds(events); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("expected the events of all devices with includeDisabled, got %v", got)
+	}
+	tests := []struct {
+		ids  []string
+		want []string
+	}{
+		{nil, []string{"a", "c"}},
+		{[]string{"b", "c"}, []string{"c"}},
+	}
+	for _, test := range tests {
+		latest, err = store.LatestPerDevice(test.ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := eventDeviceIds(latest); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("LatestPerDevice(%v) = %v, want %v", test.ids, got, test.want)
+		}
+	}
+}
+
+// Returns a store with events of devices a, b and c, of which a and c are enabled
+func newRestrictedTestStore() EventStore {
+	cache := newTestCache(1000, EventStoreOptions{})
+	for _, deviceId := range []string{"a", "b", "c"} {
+		cache.store(Event{DeviceId: deviceId, CreationTime: 100, Data: map[string]interface{}{"level": 2.5}})
+	}
+	enabled := NewEnabledDevices(nil, 0)
+	enabled.enabled = map[string]bool{"a": true, "c": true}
+	return enabled.RestrictStore(cache)
+}
+
+func TestRestrictStoreStreamEvents(t *testing.T) {
+	store := newRestrictedTestStore()
+	tests := []struct {
+		query EventQuery
+		want  []string
+	}{
+		{EventQuery{}, []string{"a", "c"}},
+		{EventQuery{DeviceId: "b"}, []string{}},
+		{EventQuery{IncludeDisabled: true}, []string{"a", "b", "c"}},
+	}
+	for _, test := range tests {
+		var events []Event
+		err := store.StreamEvents(test.query, func(e Event) error {
+			events = append(events, e)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := eventDeviceIds(events); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("streaming %+v gave %v, want %v", test.query, got, test.want)
+		}
+	}
+}
+
+func TestRestrictStoreLatestEvent(t *testing.T) {
+	store := newRestrictedTestStore()
+	for deviceId, want := range map[string]bool{"a": true, "b": false, "unknown": false} {
+		latest, err := store.LatestEvent(deviceId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (latest != nil) != want {
+			t.Errorf("expected a latest event of %s: %v, got %+v", deviceId, want, latest)
+		}
+	}
+}
+
+func TestRestrictStoreListEventsPaged(t *testing.T) {
+	store := newRestrictedTestStore()
+	page, err := store.ListEventsPaged("", "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, edge := range page.Edges {
+		ids = append(ids, edge.Node.DeviceId)
+	}
+	if !reflect.DeepEqual(ids, []string{"a"}) || !page.HasNextPage {
+		t.Fatalf("expected a first page with the event of a, got %+v", page)
+	}
+	// Paging continues after the left out event
+	page, err = store.ListEventsPaged("", page.EndCursor, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Edges) != 1 || page.Edges[0].Node.DeviceId != "c" || page.HasNextPage {
+		t.Errorf("expected a last page with the event of c, got %+v", page)
+	}
+	page, err = store.ListEventsPaged("b", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Edges) != 0 || page.HasNextPage {
+		t.Errorf("expected no events of disabled device b, got %+v", page)
+	}
+}
+
+func TestRestrictStoreEventStats(t *testing.T) {
+	store := newRestrictedTestStore()
+	stats, err := store.EventStats("a", "level", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Count != 1 {
+		t.Errorf("expected one event of a, got %+v", stats)
+	}
+	stats, err = store.EventStats("b", "level", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Count != 0 || stats.Max != nil {
+		t.Errorf("expected no events of disabled device b, got %+v", stats)
+	}
+	if _, err = store.EventStats("b", "", 0, 0); err == nil {
+		t.Error("expected the field to be validated for a disabled device")
+	}
+}
+
+func TestRestrictStoreEventSeries(t *testing.T) {
+	store := newRestrictedTestStore()
+	query := SeriesQuery{DeviceId: "a", Field: "level", Since: 60, Until: 180, BucketSeconds: 60, Aggregation: AggregateLast, IncludeEmpty: true}
+	points, err := store.EventSeries(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 3 || points[0].Value == nil || *points[0].Value != 2.5 {
+		t.Errorf("expected the event of a in the first of 3 buckets, got %+v", points)
+	}
+	query.DeviceId = "b"
+	points, err = store.EventSeries(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 3 || points[0].Value != nil {
+		t.Errorf("expected 3 empty buckets for disabled device b, got %+v", points)
+	}
+}
+
+func TestRestrictStoreListEventsCounted(t *testing.T) {
+	store := newRestrictedTestStore()
+	list, err := store.ListEventsCounted(EventQuery{Max: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.TotalCount != 2 || !reflect.DeepEqual(eventDeviceIds(list.Events), []string{"a"}) {
+		t.Errorf("expected 2 events of enabled devices and the first of them, got %+v", list)
+	}
+}
@@ -5,9 +5,22 @@
 package api
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,93 +28,1307 @@ import (
 	"github.com/apache/qpid-proton/go/pkg/electron"
 )
 
+type ConnectionState string
+
+const (
+	Disconnected ConnectionState = "disconnected"
+	Connected    ConnectionState = "connected"
+	Reconnecting ConnectionState = "reconnecting"
+)
+
+const (
+	initialBackoff = time.Second
+	maxBackoff     = time.Minute
+)
+
+// Max number of buckets returned by a series query
+const maxSeriesBuckets = 10000
+
+// Number of most recent events checked for redelivered duplicates
+const dedupLookback = 64
+
+// Options for connecting to the event store
+type EventStoreOptions struct {
+	// If set, the connection is made over TLS using this configuration
+	TLSConfig *tls.Config
+	// SASL credentials, the connection is anonymous when Username is empty
+	Username string
+	Password string
+	// AMQP container id, defaults to dings-api
+	ContainerId string
+	// Number of messages the broker may send ahead of processing, per topic.
+	// 0 uses the electron default of one message at a time.
+	Prefetch int
+	// Messages with a larger body are rejected without decoding, 0 means no limit
+	MaxMessageBytes int
+	// Renames applied to the data of received events
+	FieldAliases FieldAliases
+	// Names of the application properties and message annotations kept in the meta of received events
+	MetaProperties []string
+	// Maximum delay between frames requested from the event store. The connection is closed
+	// if no frames arrive within twice this delay, 0 disables heartbeats.
+	Heartbeat time.Duration
+	// Collapse consecutive events from a device with identical data into one event
+	CompactRepeats bool
+	// Time without messages on a topic after which the link is checked, 0 waits forever.
+	// Without heartbeats a silent link cannot be told apart from a stalled one, and is reconnected.
+	ReceiveTimeout time.Duration
+	// When set, the cache window starts at a multiple of this many seconds since the epoch, so that
+	// events are pruned a whole bucket at a time. 0 prunes on a rolling window.
+	PruneAlign int64
+	// Called with each new event after it is added to the cache, before the message is accepted.
+	// Errors are logged, the message is accepted regardless.
+	Persist func(Event) error
+}
+
 type eventCache struct {
-	receiver      electron.Receiver
+	options    EventStoreOptions
+	connection electron.Connection
+	receivers  map[string]electron.Receiver
+	topics     []string
+	// Next offset to consume for each topic, used when reconnecting
+	offsets       map[string]int64
+	state         ConnectionState
+	closed        bool
 	eventStoreUrl string
 	mutex         sync.Mutex
 	data          []Event
 	window        int64
+	maxEvents     int
+	cacheFile     string
+	// Number of events pruned from the head of data, keeps cursor indexes stable
+	base        int
+	subscribers map[chan Event]bool
+	// Newest creation time seen for each device, kept when events are pruned
+	lastSeen map[string]int64
+	// Lower bound on the creation time of events requested from the event store
+	startSince int64
+	rejected   *rejectedLog
+	// Absolute indexes of the stored events of each device, oldest first, so that queries for a
+	// device do not scan the events of other devices
+	deviceIndex map[string][]int
+	// Topics whose messages carry no offset, so that their offset is counted from the start offset
+	// and may drift from the event store. These offsets are not saved in the snapshot.
+	estimated map[string]bool
 }
 
-func NewEventCache(eventStoreUrl string, window int64) *eventCache {
-	return &eventCache{
+func NewEventCache(eventStoreUrl string, window int64, maxEvents int, cacheFile string, options EventStoreOptions) *eventCache {
+	cache := &eventCache{
+		options:       options,
 		eventStoreUrl: eventStoreUrl,
 		window:        window,
+		maxEvents:     maxEvents,
+		cacheFile:     cacheFile,
+		state:         Disconnected,
 		data:          make([]Event, 0),
+		subscribers:   make(map[chan Event]bool),
+		lastSeen:      make(map[string]int64),
+		rejected:      newRejectedLog(rejectedHistory),
+		deviceIndex:   make(map[string][]int),
+		estimated:     make(map[string]bool),
+	}
+	if cacheFile != "" {
+		err := cache.load()
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Unable to load event cache from %s, starting empty: %v", cacheFile, err)
+		}
 	}
+	return cache
+}
+
+// Contents of the snapshot file
+type snapshot struct {
+	// Next offset to consume for each topic
+	Offsets map[string]int64 `json:"offsets"`
+	Events  []Event          `json:"events"`
 }
 
-func (cache *eventCache) Connect(topic string, offset int64) error {
-	tcpConn, err := net.Dial("tcp", cache.eventStoreUrl)
+// Restore events and offsets from the snapshot file, dropping events outside the window
+func (cache *eventCache) load() error {
+	contents, err := ioutil.ReadFile(cache.cacheFile)
 	if err != nil {
 		return err
 	}
-	amqpConn, err := electron.NewConnection(tcpConn, electron.ContainerId("dings-api"))
+	var saved snapshot
+	err = decodeJSON(contents, &saved)
+	if err != nil {
+		// Older snapshots only contain the events
+		err = decodeJSON(contents, &saved.Events)
+		if err != nil {
+			return err
+		}
+	}
 
 	now := time.Now().UTC().Unix()
-	since := now - cache.window
+	since := cache.windowStart(now)
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for _, e := range saved.Events {
+		if e.LastSeen() >= since {
+			cache.store(e)
+		}
+	}
+	cache.offsets = saved.Offsets
+	cache.prune(now)
+	log.Printf("Loaded %d events from %s", len(cache.data), cache.cacheFile)
+	return nil
+}
+
+// Write the cached events and offsets to the snapshot file, if one is configured
+func (cache *eventCache) Snapshot() error {
+	if cache.cacheFile == "" {
+		return nil
+	}
+	cache.mutex.Lock()
+	offsets := make(map[string]int64)
+	for topic, offset := range cache.offsets {
+		if !cache.estimated[topic] {
+			offsets[topic] = offset
+		}
+	}
+	contents, err := json.Marshal(snapshot{
+		Offsets: offsets,
+		Events:  cache.data,
+	})
+	cache.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that a crash never leaves a half-written snapshot
+	tmpFile := cache.cacheFile + ".tmp"
+	err = ioutil.WriteFile(tmpFile, contents, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, cache.cacheFile)
+}
+
+// Write a snapshot every interval until the context is done. An interval of 0 disables periodic
+// snapshots, leaving the one written on shutdown.
+func (cache *eventCache) RunSnapshots(ctx context.Context, interval time.Duration) {
+	if cache.cacheFile == "" || interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := cache.Snapshot()
+			if err != nil {
+				log.Println("Error writing event cache snapshot", err)
+			}
+		}
+	}
+}
+
+// Where to start consuming the event store topics
+type StartPosition struct {
+	Offset int64
+	// Only events created at or after this time, in addition to the window. 0 means the start of the window.
+	Since int64
+}
+
+// Parse a start position, which is either an offset, earliest, latest or @<timestamp>
+func ParseStartPosition(value string, now int64) (StartPosition, error) {
+	switch {
+	case value == "earliest":
+		return StartPosition{}, nil
+	case value == "latest":
+		return StartPosition{Since: now}, nil
+	case strings.HasPrefix(value, "@"):
+		since, err := strconv.ParseInt(value[1:], 10, 64)
+		if err != nil {
+			return StartPosition{}, fmt.Errorf("invalid timestamp in start position %s", value)
+		}
+		return StartPosition{Since: since}, nil
+	default:
+		offset, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || offset < 0 {
+			return StartPosition{}, fmt.Errorf("invalid start position %s, expected an offset, earliest, latest or @<timestamp>", value)
+		}
+		return StartPosition{Offset: offset}, nil
+	}
+}
 
+// Connect to the event store, subscribing to each of the topics starting at the position
+func (cache *eventCache) Connect(topics []string, position StartPosition) error {
+	offsets := make(map[string]int64)
+	for _, topic := range topics {
+		offsets[topic] = position.Offset
+	}
+	cache.mutex.Lock()
+	cache.startSince = position.Since
+	cache.mutex.Unlock()
+	return cache.connect(topics, offsets)
+}
+
+// Connect to the event store, resuming each topic from the offset stored in the snapshot.
+// Topics without a stored offset start at offset.
+func (cache *eventCache) Resume(topics []string, offset int64) error {
+	cache.mutex.Lock()
+	offsets := make(map[string]int64)
+	for _, topic := range topics {
+		if saved, ok := cache.offsets[topic]; ok {
+			offsets[topic] = saved
+		} else {
+			offsets[topic] = offset
+		}
+	}
+	cache.mutex.Unlock()
+	log.Printf("Resuming from offsets %v", offsets)
+	return cache.connect(topics, offsets)
+}
+
+// Open a connection to the event store with the given container id
+func dialEventStore(eventStoreUrl string, containerId string, options EventStoreOptions) (electron.Connection, error) {
+	var tcpConn net.Conn
+	var err error
+	if options.TLSConfig != nil {
+		tcpConn, err = tls.Dial("tcp", eventStoreUrl, options.TLSConfig)
+	} else {
+		tcpConn, err = net.Dial("tcp", eventStoreUrl)
+	}
+	if err != nil {
+		return nil, err
+	}
+	copts := []electron.ConnectionOption{electron.ContainerId(containerId)}
+	if options.Heartbeat > 0 {
+		copts = append(copts, electron.Heartbeat(options.Heartbeat))
+	}
+	if options.Username != "" {
+		copts = append(copts, electron.User(options.Username), electron.Password([]byte(options.Password)))
+		// Proton refuses to send PLAIN credentials over an unencrypted connection unless told otherwise
+		if options.TLSConfig == nil {
+			copts = append(copts, electron.SASLAllowInsecure(true))
+		}
+	}
+	amqpConn, err := electron.NewConnection(tcpConn, copts...)
+	if err != nil {
+		tcpConn.Close()
+		return nil, err
+	}
+	return amqpConn, nil
+}
+
+// Returns the configured AMQP container id, or the default
+func (options EventStoreOptions) containerId() string {
+	if options.ContainerId == "" {
+		return "dings-api"
+	}
+	return options.ContainerId
+}
+
+// Returns the options for a receiver on the topic, starting at offset and skipping events created before since
+func (options EventStoreOptions) receiverOptions(topic string, offset int64, since int64) []electron.LinkOption {
 	props := map[amqp.Symbol]interface{}{"offset": offset, "since": since}
 	sopts := []electron.LinkOption{electron.Source(topic), electron.Filter(props)}
-	r, err := amqpConn.Receiver(sopts...)
+	if options.Prefetch > 0 {
+		sopts = append(sopts, electron.Capacity(options.Prefetch), electron.Prefetch(true))
+	}
+	return sopts
+}
+
+func (cache *eventCache) connect(topics []string, offsets map[string]int64) error {
+	amqpConn, err := dialEventStore(cache.eventStoreUrl, cache.options.containerId(), cache.options)
 	if err != nil {
 		return err
 	}
-	cache.receiver = r
+
+	now := time.Now().UTC().Unix()
+	cache.mutex.Lock()
+	since := cache.windowStart(now)
+	if cache.startSince > since {
+		since = cache.startSince
+	}
+	cache.mutex.Unlock()
+
+	receivers := make(map[string]electron.Receiver)
+	for _, topic := range topics {
+		r, err := amqpConn.Receiver(cache.options.receiverOptions(topic, offsets[topic], since)...)
+		if err != nil {
+			amqpConn.Close(err)
+			return err
+		}
+		receivers[topic] = r
+	}
+	cache.mutex.Lock()
+	cache.connection = amqpConn
+	cache.receivers = receivers
+	cache.topics = topics
+	cache.offsets = offsets
+	cache.state = Connected
+	cache.mutex.Unlock()
 	return nil
 }
 
+// Returns the current state of the event store connection
+func (cache *eventCache) State() ConnectionState {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.state
+}
+
+// Close the current connection and connect again, resuming from the last consumed offset
+func (cache *eventCache) reconnect(cause error) {
+	cache.mutex.Lock()
+	cache.state = Reconnecting
+	conn := cache.connection
+	topics := cache.topics
+	offsets := make(map[string]int64)
+	for topic, offset := range cache.offsets {
+		offsets[topic] = offset
+	}
+	cache.mutex.Unlock()
+
+	if conn != nil {
+		conn.Close(cause)
+	}
+
+	backoff := initialBackoff
+	for {
+		// Sleep between half and the full backoff to avoid reconnecting in lockstep
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)))
+		log.Printf("Reconnecting to event store %s in %v", cache.eventStoreUrl, delay)
+		time.Sleep(delay)
+		if cache.isClosed() {
+			return
+		}
+
+		err := cache.connect(topics, offsets)
+		if err == nil {
+			log.Printf("Reconnected to event store %s at offsets %v", cache.eventStoreUrl, offsets)
+			return
+		}
+		log.Printf("Error reconnecting to event store %s: %v", cache.eventStoreUrl, err)
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// Close the event store connection, causing Run to finish
+func (cache *eventCache) Close() {
+	cache.mutex.Lock()
+	cache.closed = true
+	conn := cache.connection
+	cache.mutex.Unlock()
+	if conn != nil {
+		conn.Close(nil)
+	}
+}
+
+func (cache *eventCache) isClosed() bool {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.closed
+}
+
 func (cache *eventCache) Run(done chan error) {
 	log.Printf("Connected to event store %s", cache.eventStoreUrl)
 	for {
-		if rm, err := cache.receiver.Receive(); err == nil {
-			msg := rm.Message
-			var result Event
-			err = json.Unmarshal([]byte(msg.Body().(amqp.Binary)), &result)
-			if err != nil {
-				rm.Reject()
-				log.Println("Error decoding message:", err)
-			} else {
-				cache.mutex.Lock()
-				// Prune old elements
-				now := time.Now().UTC().Unix()
-				since := now - cache.window
-				startIndex := 0
-				for i, entry := range cache.data {
-					if entry.CreationTime < since {
-						startIndex = i
-					} else {
-						break
-					}
-				}
-				cache.data = append(cache.data[startIndex:], result)
-				cache.mutex.Unlock()
-				rm.Accept()
-			}
-		} else if err == electron.Closed {
+		cache.mutex.Lock()
+		receivers := cache.receivers
+		cache.mutex.Unlock()
+
+		// The first receiver to fail decides whether we finish or reconnect
+		errs := make(chan error, len(receivers))
+		for topic, r := range receivers {
+			go cache.receive(topic, r, errs)
+		}
+		err := <-errs
+		if err == electron.Closed || cache.isClosed() {
+			cache.mutex.Lock()
+			cache.state = Disconnected
+			cache.mutex.Unlock()
 			done <- nil
 			break
 		} else {
-			log.Println("receive error %v", err)
-			done <- err
+			log.Printf("Receive error: %v", err)
+			cache.reconnect(err)
+		}
+	}
+}
+
+func (cache *eventCache) receive(topic string, r electron.Receiver, errs chan error) {
+	timeout := cache.options.ReceiveTimeout
+	if timeout <= 0 {
+		timeout = electron.Forever
+	}
+	for {
+		rm, err := r.ReceiveTimeout(timeout)
+		if err == electron.Timeout {
+			err = cache.checkIdle(topic, r)
+			if err == nil {
+				continue
+			}
+		}
+		if err != nil {
+			errs <- err
+			return
+		}
+		cache.handleMessage(topic, rm)
+	}
+}
+
+// Check a link that has not received messages within the receive timeout. A link that is still
+// open is healthy when heartbeats are enabled, since the connection closes when the peer stops
+// sending frames. Otherwise it may be stalled, and an error is returned to reconnect.
+func (cache *eventCache) checkIdle(topic string, r electron.Receiver) error {
+	select {
+	case <-r.Done():
+		return r.Error()
+	default:
+	}
+	if cache.options.Heartbeat > 0 {
+		log.Printf("No messages from %s for %s, link is alive", topic, cache.options.ReceiveTimeout)
+		return nil
+	}
+	return fmt.Errorf("no messages from %s for %s, assuming the link is stalled", topic, cache.options.ReceiveTimeout)
+}
+
+// Append an event to the cache. Must be called with the mutex held.
+func (cache *eventCache) store(event Event) {
+	if !cache.options.CompactRepeats || !cache.compact(event) {
+		cache.data = append(cache.data, event)
+		cache.deviceIndex[event.DeviceId] = append(cache.deviceIndex[event.DeviceId], cache.base+len(cache.data)-1)
+	}
+	if event.LastSeen() > cache.lastSeen[event.DeviceId] {
+		cache.lastSeen[event.DeviceId] = event.LastSeen()
+	}
+}
+
+// Returns the creation time of the oldest events to keep, aligned down to a bucket boundary if
+// PruneAlign is set
+func (cache *eventCache) windowStart(now int64) int64 {
+	since := now - cache.window
+	if align := cache.options.PruneAlign; align > 0 {
+		since -= since % align
+	}
+	return since
+}
+
+// Remove events older than the window, and the oldest events beyond the max number of events.
+// Must be called with the mutex held.
+func (cache *eventCache) prune(now int64) {
+	since := cache.windowStart(now)
+	startIndex := 0
+	for i, entry := range cache.data {
+		if entry.LastSeen() < since {
+			startIndex = i + 1
+		} else {
+			// Keep the readings of a compacted event that are still within the window
+			cache.data[i] = trimReadings(entry, since)
 			break
 		}
 	}
+	if cache.maxEvents > 0 && len(cache.data)-startIndex > cache.maxEvents {
+		startIndex = len(cache.data) - cache.maxEvents
+	}
+	// Pruned events are the oldest of their devices, so they are at the head of the device indexes
+	for _, e := range cache.data[:startIndex] {
+		indexes := cache.deviceIndex[e.DeviceId][1:]
+		if len(indexes) == 0 {
+			delete(cache.deviceIndex, e.DeviceId)
+		} else {
+			cache.deviceIndex[e.DeviceId] = indexes
+		}
+	}
+	cache.base += startIndex
+	cache.data = cache.data[startIndex:]
+	eventsPruned.Add(float64(startIndex))
+	eventCacheSize.Set(float64(len(cache.data)))
+}
+
+// Returns true if the event is already among the most recent events in the cache.
+// Must be called with the mutex held.
+func (cache *eventCache) isDuplicate(event Event) bool {
+	start := len(cache.data) - dedupLookback
+	if start < 0 {
+		start = 0
+	}
+	for i := len(cache.data) - 1; i >= start; i-- {
+		e := cache.data[i]
+		if e.DeviceId == event.DeviceId && e.hasReading(event.CreationTime) && e.Topic == event.Topic && reflect.DeepEqual(e.Data, event.Data) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the event store offset of a message, if the broker annotated it
+func messageOffset(msg amqp.Message) (int64, bool) {
+	for key, value := range msg.MessageAnnotations() {
+		if key.String() == "offset" || key.String() == "x-opt-offset" {
+			switch v := value.(type) {
+			case int64:
+				return v, true
+			case uint64:
+				return int64(v), true
+			case int32:
+				return int64(v), true
+			case uint32:
+				return int64(v), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// Returns the application properties and message annotations of a message with the given names,
+// or nil if it has none of them. An application property takes precedence over an annotation.
+func messageMeta(msg amqp.Message, names []string) map[string]interface{} {
+	if len(names) == 0 {
+		return nil
+	}
+	properties := msg.ApplicationProperties()
+	annotations := make(map[string]interface{})
+	for key, value := range msg.MessageAnnotations() {
+		annotations[key.String()] = value
+	}
+	var meta map[string]interface{}
+	for _, name := range names {
+		value, ok := properties[name]
+		if !ok {
+			value, ok = annotations[name]
+		}
+		if !ok {
+			continue
+		}
+		if meta == nil {
+			meta = make(map[string]interface{})
+		}
+		meta[name] = metaValue(value)
+	}
+	return meta
+}
+
+// Convert an AMQP value to one that can be encoded as JSON
+func metaValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case fmt.Stringer:
+		// UUIDs and other AMQP types with a string form
+		return v.String()
+	}
+	if _, err := json.Marshal(value); err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return value
+}
+
+// Returns the raw bytes of a message body
+func messageBody(msg amqp.Message) ([]byte, error) {
+	switch body := msg.Body().(type) {
+	case amqp.Binary:
+		return []byte(body), nil
+	case string:
+		return []byte(body), nil
+	case []byte:
+		return body, nil
+	default:
+		return nil, fmt.Errorf("unsupported message body type %T", body)
+	}
+}
+
+// Decode a JSON value, keeping numbers as json.Number so that large integers in event data are not
+// rounded to float64
+func decodeJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err := decoder.Decode(v)
+	if err != nil {
+		return err
+	}
+	if decoder.Decode(&struct{}{}) != io.EOF {
+		return fmt.Errorf("unexpected data after JSON value")
+	}
+	return nil
+}
+
+// Decode the event in a message from the topic, applying the field aliases. Returns the message body
+// along with the error if the message is not a valid event.
+func decodeMessage(topic string, msg amqp.Message, options EventStoreOptions) (Event, []byte, error) {
+	var result Event
+	body, err := messageBody(msg)
+	if err == nil && options.MaxMessageBytes > 0 && len(body) > options.MaxMessageBytes {
+		err = fmt.Errorf("message body of %d bytes exceeds limit of %d bytes", len(body), options.MaxMessageBytes)
+	}
+	if err == nil {
+		err = decodeJSON(body, &result)
+	}
+	if err != nil {
+		return result, body, err
+	}
+	result.Topic = topic
+	result.Meta = messageMeta(msg, options.MetaProperties)
+	if options.FieldAliases != nil {
+		options.FieldAliases.Normalize(result.Data)
+	}
+	return result, body, nil
+}
+
+func (cache *eventCache) handleMessage(topic string, rm electron.ReceivedMessage) {
+	msg := rm.Message
+	result, body, err := decodeMessage(topic, msg, cache.options)
+
+	eventsReceived.Inc()
+	cache.mutex.Lock()
+	if offset, ok := messageOffset(msg); ok {
+		cache.offsets[topic] = offset + 1
+		delete(cache.estimated, topic)
+	} else {
+		if !cache.estimated[topic] {
+			log.Printf("Messages from %s carry no offset, reconnecting from an estimated offset that is not saved in the snapshot", topic)
+			cache.estimated[topic] = true
+		}
+		cache.offsets[topic]++
+	}
+	if err != nil {
+		cache.mutex.Unlock()
+		eventsRejected.Inc()
+		cache.rejected.add(RejectedMessage{
+			Time:  time.Now().UTC().Unix(),
+			Topic: topic,
+			Body:  truncateBody(body),
+			Error: err.Error(),
+		})
+		rm.Reject()
+		log.Printf("Rejecting message from %s: %v", topic, err)
+		return
+	}
+
+	if !cache.ingest(result, time.Now().UTC().Unix()) {
+		cache.mutex.Unlock()
+		eventsDuplicate.Inc()
+		rm.Accept()
+		return
+	}
+	cache.mutex.Unlock()
+	cache.persist(result)
+	rm.Accept()
+}
+
+// Store a received event and pass it on to subscribers, unless it duplicates a recent event.
+// Returns false for a duplicate. Must be called with the mutex held.
+func (cache *eventCache) ingest(event Event, now int64) bool {
+	if cache.isDuplicate(event) {
+		return false
+	}
+	cache.store(event)
+	cache.prune(now)
+	cache.publish(event)
+	return true
+}
+
+// Pass a new event on to the persistence hook, if one is configured
+func (cache *eventCache) persist(event Event) {
+	if cache.options.Persist == nil {
+		return
+	}
+	err := cache.options.Persist(event)
+	if err != nil {
+		log.Printf("Error persisting event from %s: %v", event.DeviceId, err)
+	}
+}
+
+// Add an event to the cache, as if it was received from the event store
+func (cache *eventCache) Add(event Event) {
+	cache.mutex.Lock()
+	cache.store(event)
+	cache.prune(time.Now().UTC().Unix())
+	cache.publish(event)
+	cache.mutex.Unlock()
+	cache.persist(event)
+}
+
+// Change the window of events to keep, pruning events that fall outside the new window
+func (cache *eventCache) SetWindow(window int64) error {
+	if window <= 0 {
+		return fmt.Errorf("window must be positive, got %d", window)
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.window = window
+	cache.prune(time.Now().UTC().Unix())
+	return nil
+}
+
+// Remove the events that fell out of the window since the last event was received
+func (cache *eventCache) Prune() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.prune(time.Now().UTC().Unix())
+}
+
+// Prune the cache every interval until the context is done, so that events leave the window when
+// none arrive. An interval of 0 prunes every tenth of the window, following changes of the window.
+func (cache *eventCache) RunPruning(ctx context.Context, interval time.Duration) {
+	for {
+		wait := interval
+		if wait <= 0 {
+			wait = time.Duration(cache.Window()) * time.Second / 10
+		}
+		if wait < time.Second {
+			wait = time.Second
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			cache.Prune()
+		}
+	}
 }
 
-func (cache *eventCache) ListEvents(deviceId string, max int, since int64) ([]Event, error) {
+// Returns the window of events to keep, in seconds
+func (cache *eventCache) Window() int64 {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.window
+}
+
+// Returns the most recently rejected messages, oldest first, and the number of messages rejected since startup
+func (cache *eventCache) Rejected() ([]RejectedMessage, int64) {
+	return cache.rejected.list()
+}
+
+// Register for events added to the cache. The returned function must be called to unregister.
+func (cache *eventCache) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+	cache.mutex.Lock()
+	cache.subscribers[ch] = true
+	cache.mutex.Unlock()
+	return ch, func() {
+		cache.mutex.Lock()
+		delete(cache.subscribers, ch)
+		cache.mutex.Unlock()
+	}
+}
+
+// Send an event to all subscribers, dropping it for subscribers that are not keeping up.
+// Must be called with the mutex held.
+func (cache *eventCache) publish(event Event) {
+	for ch := range cache.subscribers {
+		select {
+		case ch <- event:
+		default:
+			log.Println("Dropping event for slow subscriber")
+		}
+	}
+}
+
+// List the events matching the query. Events from all topics are held in a single cache.
+func (cache *eventCache) ListEvents(query EventQuery) ([]Event, error) {
+	events, _, err := cache.scanEvents(query, false)
+	return events, err
+}
+
+// List the events matching the query, along with the number of events matching before max is applied
+func (cache *eventCache) ListEventsCounted(query EventQuery) (EventList, error) {
+	events, total, err := cache.scanEvents(query, true)
+	if err != nil {
+		return EventList{}, err
+	}
+	return EventList{TotalCount: total, Events: events}, nil
+}
+
+// Collect up to max matching events, and count all matches if count is set. Without count the
+// scan stops at max, and the returned count is the number of collected events.
+func (cache *eventCache) scanEvents(query EventQuery, count bool) ([]Event, int, error) {
+	err := query.Validate()
+	if err != nil {
+		return nil, 0, err
+	}
 	cache.mutex.Lock()
 	defer cache.mutex.Unlock()
 	var ret []Event = make([]Event, 0)
 	numValues := 0
-	for _, e := range cache.data {
-		if (deviceId == "" || e.DeviceId == deviceId) && e.CreationTime >= since {
-			ret = append(ret, e)
+	var matched []Event
+	n := cache.numStored(query.DeviceId)
+	for i := 0; i < n; i++ {
+		stored := cache.stored(query.DeviceId, i)
+		if query.Order == Descending {
+			stored = cache.stored(query.DeviceId, n-1-i)
+		}
+		matched, err = query.matchReadings(stored, matched[:0])
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, e := range matched {
 			numValues += 1
-			if max > 0 && numValues >= max {
-				break
+			if query.Max <= 0 || len(ret) < query.Max {
+				ret = append(ret, e)
+			}
+		}
+		if !count && query.Max > 0 && numValues >= query.Max {
+			break
+		}
+	}
+	return ret, numValues, nil
+}
+
+// Returns the number of stored events of the device, or of all devices if deviceId is empty.
+// Must be called with the mutex held.
+func (cache *eventCache) numStored(deviceId string) int {
+	if deviceId == "" {
+		return len(cache.data)
+	}
+	return len(cache.deviceIndex[deviceId])
+}
+
+// Returns the i-th oldest stored event of the device, or of all devices if deviceId is empty.
+// Must be called with the mutex held.
+func (cache *eventCache) stored(deviceId string, i int) Event {
+	if deviceId == "" {
+		return cache.data[i]
+	}
+	return cache.data[cache.deviceIndex[deviceId][i]-cache.base]
+}
+
+// Append the readings of a stored event that match the query, in the query order. Each reading of
+// a compacted event is matched by itself, and the matches are collapsed again for compacted queries.
+func (query *EventQuery) matchReadings(stored Event, matched []Event) ([]Event, error) {
+	start := len(matched)
+	for j := 0; j < stored.Count(); j++ {
+		e := stored.reading(j)
+		if query.Order == Descending {
+			e = stored.reading(stored.Count() - 1 - j)
+		}
+		match, err := query.matches(e)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			matched = append(matched, e)
+		}
+	}
+	if len(matched) > start && query.Compacted {
+		readings := matched[start:]
+		if query.Order == Descending {
+			readings = reverseEvents(readings)
+		}
+		matched = append(matched[:start], compactReadings(readings))
+	}
+	return matched, nil
+}
+
+// Number of stored events scanned per lock acquisition when streaming events
+const streamChunk = 500
+
+// Call fn for each event matching the query, oldest first, without holding the cache lock while fn
+// runs. Events added while streaming are included, events pruned before they are reached are not.
+func (cache *eventCache) StreamEvents(query EventQuery, fn func(Event) error) error {
+	err := query.Validate()
+	if err != nil {
+		return err
+	}
+	if query.Order == Descending {
+		return fmt.Errorf("events can only be streamed in ascending order")
+	}
+	numValues := 0
+	// Absolute index of the next stored event, stable across pruning
+	next := 0
+	var matched []Event
+	for {
+		cache.mutex.Lock()
+		if next < cache.base {
+			next = cache.base
+		}
+		end := next - cache.base + streamChunk
+		if end > len(cache.data) {
+			end = len(cache.data)
+		}
+		matched = matched[:0]
+		for _, stored := range cache.data[next-cache.base : end] {
+			matched, err = query.matchReadings(stored, matched)
+			if err != nil {
+				cache.mutex.Unlock()
+				return err
 			}
 		}
+		done := end == len(cache.data)
+		next = cache.base + end
+		cache.mutex.Unlock()
+
+		for _, e := range matched {
+			err = fn(e)
+			if err != nil {
+				return err
+			}
+			numValues++
+			if query.Max > 0 && numValues >= query.Max {
+				return nil
+			}
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// Returns the events in reverse order
+func reverseEvents(events []Event) []Event {
+	ret := make([]Event, len(events))
+	for i, e := range events {
+		ret[len(events)-1-i] = e
+	}
+	return ret
+}
+
+// Compute statistics for a numeric field over the events of a device. An until of 0 means no upper bound.
+func (cache *eventCache) EventStats(deviceId string, field string, since int64, until int64) (EventStats, error) {
+	err := validateField(field)
+	if err != nil {
+		return EventStats{}, err
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	var acc statsAccumulator
+	for _, index := range cache.deviceIndex[deviceId] {
+		stored := cache.data[index-cache.base]
+		for i := 0; i < stored.Count(); i++ {
+			e := stored.reading(i)
+			if e.DeviceId != deviceId || e.CreationTime < since || (until > 0 && e.CreationTime > until) {
+				continue
+			}
+			err = acc.add(e, field)
+			if err != nil {
+				return EventStats{}, err
+			}
+		}
+	}
+	return acc.stats(), nil
+}
+
+// Statistics for a numeric field, accumulated one event at a time in creation order
+type statsAccumulator struct {
+	count               int
+	min, max, sum, last float64
+}
+
+// Add the value of the field in the event, if it has one
+func (acc *statsAccumulator) add(e Event, field string) error {
+	value, ok := lookupField(e.Data, field)
+	if !ok || value == nil {
+		return nil
+	}
+	n := floatValue(value)
+	if n == nil {
+		return fmt.Errorf("field %s is not numeric", field)
+	}
+	v := *n
+	if acc.count == 0 || v < acc.min {
+		acc.min = v
+	}
+	if acc.count == 0 || v > acc.max {
+		acc.max = v
+	}
+	acc.sum += v
+	acc.last = v
+	acc.count++
+	return nil
+}
+
+func (acc *statsAccumulator) stats() EventStats {
+	stats := EventStats{Count: acc.count}
+	if acc.count > 0 {
+		min, max, last := acc.min, acc.max, acc.last
+		avg := acc.sum / float64(acc.count)
+		stats.Min = &min
+		stats.Max = &max
+		stats.Avg = &avg
+		stats.Last = &last
+	}
+	return stats
+}
+
+// Accumulated values of a series time bucket
+type seriesBucket struct {
+	count int
+	sum   float64
+	last  float64
+}
+
+func (b *seriesBucket) point(time int64, aggregation Aggregation) SeriesPoint {
+	point := SeriesPoint{Time: time}
+	if b == nil {
+		return point
+	}
+	value := b.sum / float64(b.count)
+	if aggregation == AggregateLast {
+		value = b.last
+	}
+	point.Value = &value
+	return point
+}
+
+// Accumulates the values of a numeric field into the time buckets of a series
+type seriesAccumulator struct {
+	query     SeriesQuery
+	buckets   map[int64]*seriesBucket
+	lastIndex int64
+}
+
+func newSeriesAccumulator(query SeriesQuery) (*seriesAccumulator, error) {
+	if query.BucketSeconds <= 0 {
+		return nil, fmt.Errorf("bucketSeconds must be positive")
+	}
+	err := validateField(query.Field)
+	if err != nil {
+		return nil, err
+	}
+	return &seriesAccumulator{query: query, buckets: make(map[int64]*seriesBucket), lastIndex: -1}, nil
+}
+
+// Add the value of the field of an event within the series to its bucket
+func (acc *seriesAccumulator) add(e Event) error {
+	query := acc.query
+	if e.DeviceId != query.DeviceId || e.CreationTime < query.Since || (query.Until > 0 && e.CreationTime > query.Until) {
+		return nil
+	}
+	value, ok := lookupField(e.Data, query.Field)
+	if !ok || value == nil {
+		return nil
+	}
+	n := floatValue(value)
+	if n == nil {
+		return fmt.Errorf("field %s is not numeric", query.Field)
+	}
+	v := *n
+	index := (e.CreationTime - query.Since) / query.BucketSeconds
+	b, ok := acc.buckets[index]
+	if !ok {
+		b = &seriesBucket{}
+		acc.buckets[index] = b
+	}
+	b.count++
+	b.sum += v
+	b.last = v
+	if index > acc.lastIndex {
+		acc.lastIndex = index
+	}
+	return nil
+}
+
+// Returns the points of the series, oldest first
+func (acc *seriesAccumulator) points() ([]SeriesPoint, error) {
+	query := acc.query
+	ret := make([]SeriesPoint, 0)
+	if query.IncludeEmpty {
+		lastIndex := acc.lastIndex
+		if query.Until > 0 {
+			lastIndex = (query.Until - query.Since) / query.BucketSeconds
+		}
+		if lastIndex >= maxSeriesBuckets {
+			return nil, fmt.Errorf("series would have more than %d buckets", maxSeriesBuckets)
+		}
+		for index := int64(0); index <= lastIndex; index++ {
+			ret = append(ret, acc.buckets[index].point(query.Since+index*query.BucketSeconds, query.Aggregation))
+		}
+		return ret, nil
+	}
+
+	indexes := make([]int64, 0, len(acc.buckets))
+	for index := range acc.buckets {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+	for _, index := range indexes {
+		ret = append(ret, acc.buckets[index].point(query.Since+index*query.BucketSeconds, query.Aggregation))
 	}
 	return ret, nil
 }
+
+// Aggregate a numeric field over the events of a device into fixed size time buckets
+func (cache *eventCache) EventSeries(query SeriesQuery) ([]SeriesPoint, error) {
+	acc, err := newSeriesAccumulator(query)
+	if err != nil {
+		return nil, err
+	}
+	cache.mutex.Lock()
+	for _, index := range cache.deviceIndex[query.DeviceId] {
+		stored := cache.data[index-cache.base]
+		for i := 0; i < stored.Count(); i++ {
+			err = acc.add(stored.reading(i))
+			if err != nil {
+				cache.mutex.Unlock()
+				return nil, err
+			}
+		}
+	}
+	cache.mutex.Unlock()
+	return acc.points()
+}
+
+// Returns the newest event creation time seen for each device since startup, including pruned events
+func (cache *eventCache) LastSeen() map[string]int64 {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	lastSeen := make(map[string]int64, len(cache.lastSeen))
+	for deviceId, t := range cache.lastSeen {
+		lastSeen[deviceId] = t
+	}
+	return lastSeen
+}
+
+// Returns a summary of the cached events, with per-device counts ordered by device id
+func (cache *eventCache) Stats() CacheInfo {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	info := CacheInfo{
+		TotalEvents: len(cache.data),
+		Devices:     make([]DeviceEventCount, 0),
+	}
+	counts := make(map[string]int)
+	var oldest, newest int64
+	for i, e := range cache.data {
+		counts[e.DeviceId]++
+		if i == 0 || e.CreationTime < oldest {
+			oldest = e.CreationTime
+		}
+		if i == 0 || e.LastSeen() > newest {
+			newest = e.LastSeen()
+		}
+	}
+	if len(cache.data) > 0 {
+		info.Oldest = &oldest
+		info.Newest = &newest
+	}
+	for deviceId, count := range counts {
+		info.Devices = append(info.Devices, DeviceEventCount{DeviceId: deviceId, Count: count})
+	}
+	sort.Slice(info.Devices, func(i, j int) bool { return info.Devices[i].DeviceId < info.Devices[j].DeviceId })
+	return info
+}
+
+// Returns the newest event for the given device, or nil if there is none
+func (cache *eventCache) LatestEvent(deviceId string) (*Event, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	n := cache.numStored(deviceId)
+	if deviceId == "" || n == 0 {
+		return nil, nil
+	}
+	// The newest reading of a compacted event
+	stored := cache.stored(deviceId, n-1)
+	e := stored.reading(stored.Count() - 1)
+	return &e, nil
+}
+
+// Returns the newest event of each of the devices, in the given order, or of every device with
+// cached events ordered by device id if ids is empty. Devices without cached events are left out.
+func (cache *eventCache) LatestPerDevice(ids []string) ([]Event, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if len(ids) == 0 {
+		for deviceId := range cache.deviceIndex {
+			ids = append(ids, deviceId)
+		}
+		sort.Strings(ids)
+	}
+	latest := make([]Event, 0, len(ids))
+	for _, deviceId := range ids {
+		n := cache.numStored(deviceId)
+		if deviceId == "" || n == 0 {
+			continue
+		}
+		// The newest reading of a compacted event
+		stored := cache.stored(deviceId, n-1)
+		latest = append(latest, stored.reading(stored.Count()-1))
+	}
+	return latest, nil
+}
+
+// Cursors point at a reading of a stored event, by the absolute index of the event and the index of
+// the reading within it
+func encodeCursor(creationTime int64, index int, reading int) string {
+	return base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d:%d", creationTime, index, reading)))
+}
+
+func decodeCursor(cursor string) (int64, int, int, error) {
+	value, err := base64.URLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid cursor %q", cursor)
+	}
+	var creationTime int64
+	var index, reading int
+	_, err = fmt.Sscanf(string(value), "%d:%d:%d", &creationTime, &index, &reading)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid cursor %q", cursor)
+	}
+	return creationTime, index, reading, nil
+}
+
+// Returns the index of the first reading of the stored event after the reading at the cursor. Pruning
+// removes the oldest readings of a compacted event, so the reading is looked up by creation time when
+// the index no longer matches.
+func nextReading(e Event, creationTime int64, reading int) int {
+	if reading < e.Count() && e.reading(reading).CreationTime == creationTime {
+		return reading + 1
+	}
+	next := 0
+	for next < e.Count() && e.reading(next).CreationTime <= creationTime {
+		next++
+	}
+	return next
+}
+
+func (cache *eventCache) ListEventsPaged(deviceId string, after string, max int) (EventPage, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	page := EventPage{Edges: make([]EventEdge, 0)}
+	start, first := 0, 0
+	if after != "" {
+		creationTime, index, reading, err := decodeCursor(after)
+		if err != nil {
+			return page, err
+		}
+		// The event at the cursor may have been pruned already. It is paged again from the reading
+		// after the cursor, as readings may have been collapsed into it since.
+		start = index - cache.base
+		if start < 0 {
+			start = 0
+		} else if start < len(cache.data) {
+			first = nextReading(cache.data[start], creationTime, reading)
+		}
+	}
+	for i := start; i < len(cache.data); i++ {
+		stored := cache.data[i]
+		if deviceId != "" && stored.DeviceId != deviceId {
+			continue
+		}
+		j := 0
+		if i == start {
+			j = first
+		}
+		// Each reading of a compacted event is paged by itself, as in events
+		for ; j < stored.Count(); j++ {
+			if max > 0 && len(page.Edges) >= max {
+				page.HasNextPage = true
+				break
+			}
+			e := stored.reading(j)
+			page.Edges = append(page.Edges, EventEdge{
+				Cursor: encodeCursor(e.CreationTime, cache.base+i, j),
+				Node:   e,
+			})
+		}
+		if page.HasNextPage {
+			break
+		}
+	}
+	if len(page.Edges) > 0 {
+		page.EndCursor = page.Edges[len(page.Edges)-1].Cursor
+	}
+	return page, nil
+}
@@ -0,0 +1,229 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func newTestCache(window int64, options EventStoreOptions) *eventCache {
+	return NewEventCache("amqp://localhost:5672", window, 0, "", options)
+}
+
+// Returns the creation times of the stored events, oldest first
+func creationTimes(events []Event) []int64 {
+	times := make([]int64, 0, len(events))
+	for _, e := range events {
+		times = append(times, e.CreationTime)
+	}
+	return times
+}
+
+func TestPrune(t *testing.T) {
+	const now = 1000
+	tests := []struct {
+		name  string
+		times []int64
+		want  []int64
+	}{
+		{"empty", nil, []int64{}},
+		{"all within window", []int64{900, 950, 1000}, []int64{900, 950, 1000}},
+		{"oldest stale", []int64{899, 900, 950}, []int64{900, 950}},
+		{"several stale", []int64{100, 200, 899, 900, 1000}, []int64{900, 1000}},
+		{"all stale", []int64{100, 200, 899}, []int64{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := newTestCache(100, EventStoreOptions{})
+			for _, time := range test.times {
+				cache.store(Event{DeviceId: "dev1", CreationTime: time})
+			}
+			cache.prune(now)
+			got := creationTimes(cache.data)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("prune kept %v, want %v", got, test.want)
+			}
+			if len(cache.deviceIndex["dev1"]) != len(test.want) {
+				t.Errorf("device index has %d events, want %d", len(cache.deviceIndex["dev1"]), len(test.want))
+			}
+		})
+	}
+}
+
+func TestPruneMaxEvents(t *testing.T) {
+	cache := newTestCache(100, EventStoreOptions{})
+	cache.maxEvents = 2
+	for _, time := range []int64{800, 910, 920, 930} {
+		cache.store(Event{DeviceId: "dev1", CreationTime: time})
+	}
+	cache.prune(1000)
+	got := creationTimes(cache.data)
+	if want := []int64{920, 930}; !reflect.DeepEqual(got, want) {
+		t.Errorf("prune kept %v, want %v", got, want)
+	}
+	if cache.base != 2 {
+		t.Errorf("base is %d after pruning 2 events", cache.base)
+	}
+}
+
+func TestIngestDuplicate(t *testing.T) {
+	cache := newTestCache(100, EventStoreOptions{})
+	event := Event{DeviceId: "dev1", CreationTime: 950, Topic: "events", Data: map[string]interface{}{"motion": true}}
+	if !cache.ingest(event, 1000) {
+		t.Fatal("first event was taken for a duplicate")
+	}
+	// A redelivery after a reconnect is an identical copy
+	redelivered := Event{DeviceId: "dev1", CreationTime: 950, Topic: "events", Data: map[string]interface{}{"motion": true}}
+	if cache.ingest(redelivered, 1000) {
+		t.Error("redelivered event was not taken for a duplicate")
+	}
+	if len(cache.data) != 1 {
+		t.Errorf("expected a single stored event, got %d", len(cache.data))
+	}
+
+	// Events differing in any of the compared fields are stored
+	others := []Event{
+		{DeviceId: "dev2", CreationTime: 950, Topic: "events", Data: map[string]interface{}{"motion": true}},
+		{DeviceId: "dev1", CreationTime: 951, Topic: "events", Data: map[string]interface{}{"motion": true}},
+		{DeviceId: "dev1", CreationTime: 950, Topic: "other", Data: map[string]interface{}{"motion": true}},
+		{DeviceId: "dev1", CreationTime: 950, Topic: "events", Data: map[string]interface{}{"motion": false}},
+	}
+	for _, e := range others {
+		if !cache.ingest(e, 1000) {
+			t.Errorf("event %+v was taken for a duplicate", e)
+		}
+	}
+	if len(cache.data) != 1+len(others) {
+		t.Errorf("expected %d stored events, got %d", 1+len(others), len(cache.data))
+	}
+}
+
+func TestIngestDuplicateLookback(t *testing.T) {
+	cache := newTestCache(10000, EventStoreOptions{})
+	first := Event{DeviceId: "dev1", CreationTime: 1000}
+	cache.ingest(first, 1000)
+	for i := 0; i < dedupLookback; i++ {
+		cache.ingest(Event{DeviceId: "dev2", CreationTime: int64(1001 + i)}, 1000)
+	}
+	// Only the most recent events are checked, to keep ingestion cheap
+	if !cache.ingest(first, 1000) {
+		t.Error("event beyond the lookback was taken for a duplicate")
+	}
+}
+
+func TestIngestDuplicateCompacted(t *testing.T) {
+	cache := newTestCache(100, EventStoreOptions{CompactRepeats: true})
+	data := map[string]interface{}{"motion": true}
+	for _, time := range []int64{950, 960, 960, 970} {
+		cache.ingest(Event{DeviceId: "dev1", CreationTime: time, Data: data}, 1000)
+	}
+	if len(cache.data) != 1 {
+		t.Fatalf("expected one compacted event, got %d", len(cache.data))
+	}
+	if got := cache.data[0].Expand(); len(got) != 3 {
+		t.Errorf("expected the redelivered reading to be skipped, got readings %v", creationTimes(got))
+	}
+}
+
+// A fleet of a thousand devices reporting a hundred events each
+func newBenchmarkCache() *eventCache {
+	const devices, events = 1000, 100
+	cache := newTestCache(devices*events, EventStoreOptions{})
+	for i := 0; i < devices*events; i++ {
+		cache.store(Event{
+			DeviceId:     fmt.Sprintf("dev%d", i%devices),
+			CreationTime: int64(i),
+			Data:         map[string]interface{}{"temperature": map[string]interface{}{"celcius": float64(i % 30)}},
+		})
+	}
+	return cache
+}
+
+func BenchmarkListEventsDevice(b *testing.B) {
+	cache := newBenchmarkCache()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		events, err := cache.ListEvents(EventQuery{DeviceId: "dev500"})
+		if err != nil || len(events) != 100 {
+			b.Fatalf("expected 100 events, got %d: %v", len(events), err)
+		}
+	}
+}
+
+// A prefix query scans all stored events, as device queries did before the device index
+func BenchmarkListEventsDeviceScan(b *testing.B) {
+	cache := newBenchmarkCache()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		events, err := cache.ListEvents(EventQuery{DeviceIdPrefix: "dev500"})
+		if err != nil || len(events) != 100 {
+			b.Fatalf("expected 100 events, got %d: %v", len(events), err)
+		}
+	}
+}
+
+func BenchmarkListEventsAllDevices(b *testing.B) {
+	cache := newBenchmarkCache()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := cache.ListEvents(EventQuery{Max: 100, Order: Descending}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestLargeIntegers(t *testing.T) {
+	var event Event
+	err := decodeJSON([]byte(`{"deviceId":"dev1","creationTime":100,"data":{"counter":9007199254740993}}`), &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The raw data is encoded as received
+	raw, err := json.Marshal(event.DecodedData().Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != `{"counter":9007199254740993}` {
+		t.Errorf("expected the counter to round trip exactly, got %s", raw)
+	}
+
+	// Filters compare integers exactly, 2^53+1 and 2^53 are the same as float64
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"9007199254740993", true},
+		{"9007199254740992", false},
+	}
+	for _, test := range tests {
+		filter := EventFilter{Field: "counter", Op: OpEQ, Value: test.value}
+		matched, err := filter.Match(event.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matched != test.want {
+			t.Errorf("expected EQ %s to match %v, got %v", test.value, test.want, matched)
+		}
+	}
+
+	if i := intValue(event.Data["counter"]); i == nil || *i != 9007199254740993 {
+		t.Errorf("expected int 9007199254740993, got %v", i)
+	}
+
+	// Statistics are computed as floats, so the counter is accepted and rounded to 2^53
+	cache := newTestCache(1000, EventStoreOptions{})
+	cache.ingest(event, 200)
+	stats, err := cache.EventStats("dev1", "counter", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Count != 1 || stats.Max == nil || *stats.Max != 9007199254740992 {
+		t.Errorf("expected one counter of 2^53, got %+v", stats)
+	}
+}
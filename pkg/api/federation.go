@@ -0,0 +1,123 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package api
+
+import (
+	"context"
+	"fmt"
+)
+
+// Merges the devices of several device registries
+type federatedRegistry struct {
+	// Registries in order of preference, when a device is listed by more than one
+	registries []*deviceRegistry
+}
+
+// Location and credentials of one of several device registries
+type DeviceRegistryConfig struct {
+	// Name set as the source of devices listed by the registry, must be unique
+	Source   string
+	Url      string
+	Username string
+	Password string
+}
+
+// Create a client for the registries, in order of preference. The source in options is ignored.
+func NewFederatedRegistry(configs []DeviceRegistryConfig, options DeviceRegistryOptions) (*federatedRegistry, error) {
+	f := &federatedRegistry{}
+	sources := make(map[string]bool)
+	for _, config := range configs {
+		if sources[config.Source] {
+			return nil, fmt.Errorf("duplicate device registry source %q", config.Source)
+		}
+		sources[config.Source] = true
+		options.Source = config.Source
+		f.registries = append(f.registries, NewDeviceRegistryClient(config.Url, config.Username, config.Password, options))
+	}
+	return f, nil
+}
+
+// List the devices of all registries. A device listed by several registries is taken from the first of them.
+func (f *federatedRegistry) ListDevices(ctx context.Context) ([]Device, error) {
+	devices := make([]Device, 0)
+	seen := make(map[string]bool)
+	for _, registry := range f.registries {
+		listed, err := registry.ListDevices(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, device := range listed {
+			if seen[device.ID] {
+				continue
+			}
+			seen[device.ID] = true
+			devices = append(devices, device)
+		}
+	}
+	return devices, nil
+}
+
+// Check that all registries are reachable
+func (f *federatedRegistry) Ping(ctx context.Context) error {
+	for _, registry := range f.registries {
+		if err := registry.Ping(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the device with the given id, or nil if no registry knows it
+func (f *federatedRegistry) GetDevice(ctx context.Context, id string) (*Device, error) {
+	devices, err := f.ListDevices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, device := range devices {
+		if device.ID == id {
+			return &device, nil
+		}
+	}
+	return nil, nil
+}
+
+// Update the device in the registry it is listed by
+func (f *federatedRegistry) SetEnabled(ctx context.Context, id string, enabled bool) (Device, error) {
+	registry, err := f.registryFor(ctx, id)
+	if err != nil {
+		return Device{}, err
+	}
+	return registry.SetEnabled(ctx, id, enabled)
+}
+
+// Update the device in the registry it is listed by
+func (f *federatedRegistry) Update(ctx context.Context, id string, patch DevicePatch) (Device, error) {
+	registry, err := f.registryFor(ctx, id)
+	if err != nil {
+		return Device{}, err
+	}
+	return registry.Update(ctx, id, patch)
+}
+
+// Returns the registry the device is listed by
+func (f *federatedRegistry) registryFor(ctx context.Context, id string) (*deviceRegistry, error) {
+	if len(f.registries) == 1 {
+		return f.registries[0], nil
+	}
+	// Registries are told apart by their source name
+	device, err := f.GetDevice(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if device == nil {
+		return nil, fmt.Errorf("unknown device %s", id)
+	}
+	for _, registry := range f.registries {
+		if registry.source == device.Source {
+			return registry, nil
+		}
+	}
+	return nil, fmt.Errorf("no registry for device %s", id)
+}
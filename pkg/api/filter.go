@@ -0,0 +1,231 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type FilterOp string
+
+const (
+	OpEQ  FilterOp = "EQ"
+	OpGT  FilterOp = "GT"
+	OpLT  FilterOp = "LT"
+	OpGTE FilterOp = "GTE"
+	OpLTE FilterOp = "LTE"
+)
+
+// Criteria for listing events. Zero values do not restrict the result.
+type EventQuery struct {
+	// Only events for this device, all devices if empty
+	DeviceId string
+	// Only events for devices with ids starting with this, such as greenhouse/zone1/. Cannot be
+	// combined with DeviceId.
+	DeviceIdPrefix string
+	// Only events from this topic, all topics if empty
+	Topic string
+	// Maximum number of events, applied in the requested order
+	Max   int
+	Since int64
+	// Upper bound on creation time, 0 means no bound
+	Until  int64
+	Filter *EventFilter
+	Order  SortOrder
+	// Report identical readings collapsed by CompactRepeats as one event, instead of one event per reading
+	Compacted bool
+	// Include events from devices that are unknown or disabled in the registry, when these are filtered
+	IncludeDisabled bool
+	// Only events from devices for which this returns true, all devices if nil
+	DeviceAllowed func(deviceId string) bool
+}
+
+// How far in the future since may be, to allow for clock skew between devices and the server
+const maxSinceSkew = time.Hour
+
+// Check that the query is well formed
+func (q *EventQuery) Validate() error {
+	if q.Max < 0 {
+		return fmt.Errorf("max must not be negative, got %d", q.Max)
+	}
+	if q.Since < 0 {
+		return fmt.Errorf("since must not be negative, got %d", q.Since)
+	}
+	if q.Until < 0 {
+		return fmt.Errorf("until must not be negative, got %d", q.Until)
+	}
+	if latest := time.Now().Add(maxSinceSkew).Unix(); q.Since > latest {
+		return fmt.Errorf("since %d is in the future", q.Since)
+	}
+	if q.Until > 0 && q.Until < q.Since {
+		return fmt.Errorf("until %d is before since %d", q.Until, q.Since)
+	}
+	if q.Order != "" && q.Order != Ascending && q.Order != Descending {
+		return fmt.Errorf("unknown order %s", q.Order)
+	}
+	if q.DeviceId != "" && q.DeviceIdPrefix != "" {
+		return fmt.Errorf("deviceId and deviceIdPrefix cannot be combined")
+	}
+	if q.Filter != nil {
+		err := q.Filter.Validate()
+		if err != nil {
+			return fmt.Errorf("invalid filter: %v", err)
+		}
+	}
+	return nil
+}
+
+func (q *EventQuery) matches(e Event) (bool, error) {
+	if q.DeviceId != "" && e.DeviceId != q.DeviceId {
+		return false, nil
+	}
+	if q.DeviceIdPrefix != "" && !strings.HasPrefix(e.DeviceId, q.DeviceIdPrefix) {
+		return false, nil
+	}
+	if q.Topic != "" && e.Topic != q.Topic {
+		return false, nil
+	}
+	if q.DeviceAllowed != nil && !q.DeviceAllowed(e.DeviceId) {
+		return false, nil
+	}
+	if e.CreationTime < q.Since || (q.Until > 0 && e.CreationTime > q.Until) {
+		return false, nil
+	}
+	if q.Filter != nil {
+		return q.Filter.Match(e.Data)
+	}
+	return true, nil
+}
+
+// A predicate on a field in the event data. Field is a dotted path such as temperature.celcius.
+type EventFilter struct {
+	Field string
+	Op    FilterOp
+	Value string
+}
+
+// Look up a dotted path in the event data
+func lookupField(data map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = data
+	for _, key := range strings.Split(path, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		value, ok = m[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// Check that a dotted path is well formed
+func validateField(path string) error {
+	if path == "" {
+		return fmt.Errorf("field must be set")
+	}
+	for _, key := range strings.Split(path, ".") {
+		if key == "" {
+			return fmt.Errorf("invalid field %q", path)
+		}
+	}
+	return nil
+}
+
+func (f *EventFilter) Validate() error {
+	err := validateField(f.Field)
+	if err != nil {
+		return err
+	}
+	switch f.Op {
+	case OpEQ, OpGT, OpLT, OpGTE, OpLTE:
+	default:
+		return fmt.Errorf("invalid filter op %q", f.Op)
+	}
+	return nil
+}
+
+// Compare a number from event data with a filter value. Integers decoded as json.Number are
+// compared exactly, other numbers as floats.
+func compareNumber(value interface{}, expected string) (int, error) {
+	if n, ok := value.(json.Number); ok {
+		i, err := n.Int64()
+		e, expectedErr := strconv.ParseInt(expected, 10, 64)
+		if err == nil && expectedErr == nil {
+			switch {
+			case i < e:
+				return -1, nil
+			case i > e:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	}
+	e, err := strconv.ParseFloat(expected, 64)
+	if err != nil {
+		return 0, err
+	}
+	v := floatValue(value)
+	if v == nil {
+		return 0, fmt.Errorf("invalid number %v", value)
+	}
+	switch {
+	case *v < e:
+		return -1, nil
+	case *v > e:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// Returns true if the event data matches the filter. Events without the field never match.
+func (f *EventFilter) Match(data map[string]interface{}) (bool, error) {
+	value, ok := lookupField(data, f.Field)
+	if !ok || value == nil {
+		return false, nil
+	}
+
+	var cmp int
+	switch v := value.(type) {
+	case bool:
+		if f.Op != OpEQ {
+			return false, fmt.Errorf("filter op %s not supported for boolean field %s", f.Op, f.Field)
+		}
+		expected, err := strconv.ParseBool(f.Value)
+		if err != nil {
+			return false, fmt.Errorf("filter value %q is not a boolean, as required by field %s", f.Value, f.Field)
+		}
+		return v == expected, nil
+	case float64, json.Number:
+		var err error
+		cmp, err = compareNumber(v, f.Value)
+		if err != nil {
+			return false, fmt.Errorf("filter value %q is not a number, as required by field %s", f.Value, f.Field)
+		}
+	case string:
+		cmp = strings.Compare(v, f.Value)
+	default:
+		return false, fmt.Errorf("field %s can not be compared", f.Field)
+	}
+
+	switch f.Op {
+	case OpEQ:
+		return cmp == 0, nil
+	case OpGT:
+		return cmp > 0, nil
+	case OpLT:
+		return cmp < 0, nil
+	case OpGTE:
+		return cmp >= 0, nil
+	case OpLTE:
+		return cmp <= 0, nil
+	}
+	return false, fmt.Errorf("invalid filter op %q", f.Op)
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package api
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestValidateQuery(t *testing.T) {
+	future := time.Now().Add(48 * time.Hour).Unix()
+	tests := []struct {
+		name  string
+		query EventQuery
+		err   string
+	}{
+		{"empty", EventQuery{}, ""},
+		{"bounded", EventQuery{DeviceId: "dev1", Max: 10, Since: 100, Until: 200, Order: Descending}, ""},
+		{"negative max", EventQuery{Max: -1}, "max must not be negative, got -1"},
+		{"negative since", EventQuery{Since: -5}, "since must not be negative, got -5"},
+		{"negative until", EventQuery{Until: -5}, "until must not be negative, got -5"},
+		{"since in the future", EventQuery{Since: future}, fmt.Sprintf("since %d is in the future", future)},
+		{"until before since", EventQuery{Since: 200, Until: 100}, "until 100 is before since 200"},
+		{"unknown order", EventQuery{Order: "SIDEWAYS"}, "unknown order SIDEWAYS"},
+		{"device and prefix", EventQuery{DeviceId: "a/b", DeviceIdPrefix: "a/"}, "deviceId and deviceIdPrefix cannot be combined"},
+		{"filter without field", EventQuery{Filter: &EventFilter{Op: OpEQ}}, "invalid filter: field must be set"},
+		{"filter with empty key", EventQuery{Filter: &EventFilter{Field: "temperature.", Op: OpEQ}}, `invalid filter: invalid field "temperature."`},
+		{"filter op", EventQuery{Filter: &EventFilter{Field: "motion", Op: "LIKE"}}, `invalid filter: invalid filter op "LIKE"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.query.Validate()
+			if test.err == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != test.err {
+				t.Errorf("expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestListEventsInvalidQuery(t *testing.T) {
+	cache := newTestCache(100, EventStoreOptions{})
+	_, err := cache.ListEvents(EventQuery{Max: -1})
+	if err == nil || err.Error() != "max must not be negative, got -1" {
+		t.Errorf("expected the validation error, got %v", err)
+	}
+	_, err = cache.ListEventsCounted(EventQuery{Since: 200, Until: 100})
+	if err == nil || err.Error() != "until 100 is before since 200" {
+		t.Errorf("expected the validation error, got %v", err)
+	}
+}
+
+func TestFilterMatchErrors(t *testing.T) {
+	data := map[string]interface{}{"motion": true, "temperature": map[string]interface{}{"celcius": 21.5}, "soil": []interface{}{1.0}}
+	tests := []struct {
+		filter EventFilter
+		err    string
+	}{
+		{EventFilter{Field: "motion", Op: OpGT, Value: "true"}, "filter op GT not supported for boolean field motion"},
+		{EventFilter{Field: "motion", Op: OpEQ, Value: "yes"}, `filter value "yes" is not a boolean, as required by field motion`},
+		{EventFilter{Field: "temperature.celcius", Op: OpGT, Value: "warm"}, `filter value "warm" is not a number, as required by field temperature.celcius`},
+		{EventFilter{Field: "soil", Op: OpEQ, Value: "1"}, "field soil can not be compared"},
+	}
+	for _, test := range tests {
+		_, err := test.filter.Match(data)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("expected error %q for %+v, got %v", test.err, test.filter, err)
+		}
+	}
+}
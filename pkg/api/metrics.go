@@ -0,0 +1,60 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package api
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	eventsReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dings_events_received_total",
+		Help: "Number of events received from the event store",
+	})
+	eventsRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dings_events_rejected_total",
+		Help: "Number of events rejected because they could not be decoded",
+	})
+	eventsDuplicate = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dings_events_duplicate_total",
+		Help: "Number of redelivered events skipped because they were already cached",
+	})
+	eventsPruned = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dings_events_pruned_total",
+		Help: "Number of events pruned from the event cache",
+	})
+	eventCacheSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dings_event_cache_size",
+		Help: "Number of events currently held in the event cache",
+	})
+	registryRequestDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "dings_device_registry_request_duration_seconds",
+		Help: "Latency of device registry requests",
+	})
+	registryRequestErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dings_device_registry_request_errors_total",
+		Help: "Number of failed device registry requests",
+	})
+)
+
+// Register the API metrics with the given registerer
+func RegisterMetrics(registerer prometheus.Registerer) error {
+	collectors := []prometheus.Collector{
+		eventsReceived,
+		eventsRejected,
+		eventsDuplicate,
+		eventsPruned,
+		eventCacheSize,
+		registryRequestDuration,
+		registryRequestErrors,
+	}
+	for _, c := range collectors {
+		err := registerer.Register(c)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package api
+
+import (
+	"sync"
+)
+
+// Number of rejected messages kept for inspection
+const rejectedHistory = 50
+
+// A message that was rejected because it could not be decoded
+type RejectedMessage struct {
+	// Time the message was rejected
+	Time  int64  `json:"time"`
+	Topic string `json:"topic"`
+	// Message body, truncated
+	Body  string `json:"body"`
+	Error string `json:"error"`
+}
+
+// Ring buffer of the most recently rejected messages
+type rejectedLog struct {
+	mutex    sync.Mutex
+	messages []RejectedMessage
+	next     int
+	total    int64
+}
+
+func newRejectedLog(size int) *rejectedLog {
+	return &rejectedLog{messages: make([]RejectedMessage, 0, size)}
+}
+
+func (l *rejectedLog) add(message RejectedMessage) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.total++
+	if len(l.messages) < cap(l.messages) {
+		l.messages = append(l.messages, message)
+		return
+	}
+	l.messages[l.next] = message
+	l.next = (l.next + 1) % len(l.messages)
+}
+
+// Returns the kept messages, oldest first, and the number of messages rejected since startup
+func (l *rejectedLog) list() ([]RejectedMessage, int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	result := make([]RejectedMessage, 0, len(l.messages))
+	result = append(result, l.messages[l.next:]...)
+	result = append(result, l.messages[:l.next]...)
+	return result, l.total
+}
@@ -0,0 +1,278 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package api
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apache/qpid-proton/go/pkg/electron"
+)
+
+// Serves event queries by replaying the topics from the event store on each query, instead of
+// keeping the events in memory. Trades query latency for memory.
+type replayEventStore struct {
+	eventStoreUrl string
+	topics        []string
+	window        int64
+	// Time without messages after which a topic is considered replayed
+	idleTimeout time.Duration
+	options     EventStoreOptions
+	// Number of connections opened, to give each connection its own container id
+	connections int64
+	mutex       sync.Mutex
+	state       ConnectionState
+}
+
+func NewReplayEventStore(eventStoreUrl string, topics []string, window int64, idleTimeout time.Duration, options EventStoreOptions) *replayEventStore {
+	return &replayEventStore{
+		eventStoreUrl: eventStoreUrl,
+		topics:        topics,
+		window:        window,
+		idleTimeout:   idleTimeout,
+		options:       options,
+		state:         Disconnected,
+	}
+}
+
+// Returns the state of the last connection to the event store
+func (s *replayEventStore) State() ConnectionState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.state
+}
+
+// Check that the event store can be connected to
+func (s *replayEventStore) Check() error {
+	conn, err := s.dial()
+	if err != nil {
+		return err
+	}
+	conn.Close(nil)
+	return nil
+}
+
+func (s *replayEventStore) dial() (electron.Connection, error) {
+	n := atomic.AddInt64(&s.connections, 1)
+	conn, err := dialEventStore(s.eventStoreUrl, fmt.Sprintf("%s-replay-%d", s.options.containerId(), n), s.options)
+	s.mutex.Lock()
+	if err != nil {
+		s.state = Disconnected
+	} else {
+		s.state = Connected
+	}
+	s.mutex.Unlock()
+	return conn, err
+}
+
+// Returns the topics to replay for the query
+func (s *replayEventStore) topicsFor(query EventQuery) []string {
+	if query.Topic == "" {
+		return s.topics
+	}
+	for _, topic := range s.topics {
+		if topic == query.Topic {
+			return []string{topic}
+		}
+	}
+	return nil
+}
+
+// Replay the events of a topic created at or after the start of the window and since. Calls fn for
+// each event until fn returns false, or no message arrives within the idle timeout.
+func (s *replayEventStore) replayTopic(conn electron.Connection, topic string, since int64, fn func(Event) (bool, error)) error {
+	if start := time.Now().UTC().Unix() - s.window; start > since {
+		since = start
+	}
+	return receiveTopic(conn, topic, 0, since, s.idleTimeout, s.options, fn)
+}
+
+// Receive the events of a topic from the offset, created at or after since, on a receiver of its own.
+// Calls fn for each event until fn returns false, or no message arrives within the idle timeout.
+func receiveTopic(conn electron.Connection, topic string, offset int64, since int64, idleTimeout time.Duration, options EventStoreOptions, fn func(Event) (bool, error)) error {
+	r, err := conn.Receiver(options.receiverOptions(topic, offset, since)...)
+	if err != nil {
+		return err
+	}
+	defer r.Close(nil)
+	for {
+		rm, err := r.ReceiveTimeout(idleTimeout)
+		if err == electron.Timeout {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// Messages are released rather than settled, so that replaying does not consume them. On a
+		// broker with queue semantics, released messages are redelivered to the other consumers.
+		rm.Release()
+		event, _, err := decodeMessage(topic, rm.Message, options)
+		if err != nil {
+			log.Printf("Skipping message from %s during replay: %v", topic, err)
+			continue
+		}
+		more, err := fn(event)
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+// Number of connections opened by ReadTopic, to give each connection its own container id
+var topicReads int64
+
+// Read up to max events of a topic starting at the offset, on a connection of its own so that
+// ingestion is not disturbed, and without adding them to the cache. Returns fewer events if no
+// message arrives within the idle timeout.
+func ReadTopic(eventStoreUrl string, topic string, offset int64, max int, idleTimeout time.Duration, options EventStoreOptions) ([]Event, error) {
+	n := atomic.AddInt64(&topicReads, 1)
+	conn, err := dialEventStore(eventStoreUrl, fmt.Sprintf("%s-read-%d", options.containerId(), n), options)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close(nil)
+	events := make([]Event, 0)
+	err = receiveTopic(conn, topic, offset, 0, idleTimeout, options, func(e Event) (bool, error) {
+		events = append(events, e)
+		return len(events) < max, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// Replay the topics, collecting up to max matching events. As for the cache, all matches are counted
+// if count is set, and the returned count is the number of collected events otherwise.
+func (s *replayEventStore) scanEvents(query EventQuery, count bool) ([]Event, int, error) {
+	err := query.Validate()
+	if err != nil {
+		return nil, 0, err
+	}
+	conn, err := s.dial()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close(nil)
+
+	var lists [][]Event
+	for _, topic := range s.topicsFor(query) {
+		events := make([]Event, 0)
+		err := s.replayTopic(conn, topic, query.Since, func(e Event) (bool, error) {
+			match, err := query.matches(e)
+			if err != nil {
+				return false, err
+			}
+			if match {
+				events = append(events, e)
+			}
+			// Topics are replayed oldest first, so the newest events are only known at the end
+			return count || query.Order == Descending || query.Max <= 0 || len(events) < query.Max, nil
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		lists = append(lists, events)
+	}
+	events := MergeEvents(lists, query.Order, 0)
+	total := len(events)
+	if query.Max > 0 && len(events) > query.Max {
+		events = events[:query.Max]
+	}
+	return events, total, nil
+}
+
+// List the events matching the query by replaying the event store topics
+func (s *replayEventStore) ListEvents(query EventQuery) ([]Event, error) {
+	events, _, err := s.scanEvents(query, false)
+	return events, err
+}
+
+// List the events matching the query, along with the number of events matching before max is applied
+func (s *replayEventStore) ListEventsCounted(query EventQuery) (EventList, error) {
+	events, total, err := s.scanEvents(query, true)
+	if err != nil {
+		return EventList{}, err
+	}
+	return EventList{TotalCount: total, Events: events}, nil
+}
+
+// Returns the newest event for the given device, or nil if there is none
+func (s *replayEventStore) LatestEvent(deviceId string) (*Event, error) {
+	events, err := s.ListEvents(EventQuery{DeviceId: deviceId, Order: Descending, Max: 1})
+	if err != nil || len(events) == 0 {
+		return nil, err
+	}
+	return &events[0], nil
+}
+
+// Call fn for each event matching the query, oldest first. A single topic is streamed as it is
+// replayed, events from several topics are collected first to merge them by creation time.
+func (s *replayEventStore) StreamEvents(query EventQuery, fn func(Event) error) error {
+	if query.Order == Descending {
+		return fmt.Errorf("events can only be streamed in ascending order")
+	}
+	topics := s.topicsFor(query)
+	if len(topics) != 1 {
+		events, err := s.ListEvents(query)
+		if err != nil {
+			return err
+		}
+		for _, e := range events {
+			err = fn(e)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err := query.Validate()
+	if err != nil {
+		return err
+	}
+	conn, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close(nil)
+	numValues := 0
+	return s.replayTopic(conn, topics[0], query.Since, func(e Event) (bool, error) {
+		match, err := query.matches(e)
+		if err != nil || !match {
+			return err == nil, err
+		}
+		err = fn(e)
+		if err != nil {
+			return false, err
+		}
+		numValues++
+		return query.Max <= 0 || numValues < query.Max, nil
+	})
+}
+
+// Statistics are computed on the events kept in memory, which replay mode does not keep. The query
+// fails rather than return statistics of no events.
+func (s *replayEventStore) EventStats(deviceId string, field string, since int64, until int64) (EventStats, error) {
+	return EventStats{}, fmt.Errorf("event statistics are not supported in replay mode")
+}
+
+// Series are computed on the events kept in memory, as statistics
+func (s *replayEventStore) EventSeries(query SeriesQuery) ([]SeriesPoint, error) {
+	return nil, fmt.Errorf("event series are not supported in replay mode")
+}
+
+// Cursors point into the events kept in memory, so there are no pages to resume from
+func (s *replayEventStore) ListEventsPaged(deviceId string, after string, max int) (EventPage, error) {
+	return EventPage{}, fmt.Errorf("paging events is not supported in replay mode")
+}
+
+// The devices with events are only known from the events kept in memory
+func (s *replayEventStore) LatestPerDevice(ids []string) ([]Event, error) {
+	return nil, fmt.Errorf("the latest events of several devices are not supported in replay mode")
+}
@@ -0,0 +1,213 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package api
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+)
+
+type Temperature struct {
+	Celcius          *float64 `json:"celcius,omitempty"`
+	Humidity         *float64 `json:"humidity,omitempty"`
+	HeatindexCelcius *float64 `json:"heatindexCelcius,omitempty"`
+}
+
+// Computes the heat index in celcius from the temperature in celcius and the relative humidity in percent,
+// using the NWS formula: the Rothfusz regression with its adjustments, or Steadman's simpler formula
+// when the heat index is below 80F.
+func HeatIndex(celcius float64, humidity float64) float64 {
+	t := celcius*9/5 + 32
+	rh := humidity
+	hi := 0.5 * (t + 61 + (t-68)*1.2 + rh*0.094)
+	if (hi+t)/2 >= 80 {
+		hi = -42.379 + 2.04901523*t + 10.14333127*rh - 0.22475541*t*rh - 0.00683783*t*t -
+			0.05481717*rh*rh + 0.00122874*t*t*rh + 0.00085282*t*rh*rh - 0.00000199*t*t*rh*rh
+		if rh < 13 && t >= 80 && t <= 112 {
+			hi -= ((13 - rh) / 4) * math.Sqrt((17-math.Abs(t-95))/17)
+		} else if rh > 85 && t >= 80 && t <= 87 {
+			hi += ((rh - 85) / 10) * ((87 - t) / 5)
+		}
+	}
+	return (hi - 32) * 5 / 9
+}
+
+// Fill in the heat index from the temperature and humidity, if it was not sent by the device
+func (t *Temperature) ComputeHeatIndex() {
+	if t.HeatindexCelcius != nil || t.Celcius == nil || t.Humidity == nil {
+		return
+	}
+	heatIndex := HeatIndex(*t.Celcius, *t.Humidity)
+	t.HeatindexCelcius = &heatIndex
+}
+
+type Soil struct {
+	NumSamples *int      `json:"numSamples,omitempty"`
+	Humidity   []float64 `json:"humidity,omitempty"`
+}
+
+// Type of the value sent by a scalar sensor
+type ScalarType string
+
+const (
+	FloatScalar ScalarType = "float"
+	IntScalar   ScalarType = "int"
+)
+
+// A sensor that sends a single number, such as a battery level
+type ScalarSensor struct {
+	// Key of the sensor in the event data, also used as its field name in the schema
+	Name        string
+	Type        ScalarType
+	Description string
+}
+
+// Scalar sensors with a typed field in the schema. A sensor added here is decoded into
+// EventData.Scalars and gets a field of the Data type.
+var ScalarSensors = []ScalarSensor{
+	{Name: "battery", Type: FloatScalar, Description: "Battery level in percent"},
+	{Name: "light", Type: FloatScalar, Description: "Illuminance in lux"},
+	{Name: "co2", Type: IntScalar, Description: "CO2 concentration in ppm"},
+	{Name: "pressure", Type: FloatScalar, Description: "Air pressure in hPa"},
+}
+
+// Returns the scalar sensor with the given key, if there is one
+func scalarSensor(key string) (ScalarSensor, bool) {
+	for _, sensor := range ScalarSensors {
+		if sensor.Name == key {
+			return sensor, true
+		}
+	}
+	return ScalarSensor{}, false
+}
+
+// Decode the value of the sensor, or return nil if it does not have the type of the sensor
+func (s ScalarSensor) decode(value interface{}) interface{} {
+	if s.Type == IntScalar {
+		if i := intValue(value); i != nil {
+			return *i
+		}
+		return nil
+	}
+	if f := floatValue(value); f != nil {
+		return *f
+	}
+	return nil
+}
+
+// Typed view of Event.Data. Sensors missing from the data, or with an unexpected shape, are nil, as are
+// sensor fields with an unexpected type.
+type EventData struct {
+	Motion      *bool
+	Temperature *Temperature
+	Soil        *Soil
+	// Decoded values of the ScalarSensors in the data, as float64 or int. Values with an
+	// unexpected type are left out.
+	Scalars map[string]interface{}
+	// Data for sensors that are not modelled above
+	Other map[string]interface{}
+	// The event data as received
+	Raw map[string]interface{}
+}
+
+// Returns the value as a float, or nil if it is not a number
+func floatValue(value interface{}) *float64 {
+	switch v := value.(type) {
+	case float64:
+		return &v
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return nil
+		}
+		return &f
+	}
+	return nil
+}
+
+// Returns the value as an int, or nil if it is not a whole number. Numbers decoded as json.Number
+// keep their precision beyond 2^53.
+func intValue(value interface{}) *int {
+	if n, ok := value.(json.Number); ok {
+		if i, err := strconv.ParseInt(string(n), 10, 0); err == nil {
+			v := int(i)
+			return &v
+		}
+	}
+	f := floatValue(value)
+	if f == nil || *f != math.Trunc(*f) {
+		return nil
+	}
+	i := int(*f)
+	return &i
+}
+
+// Decode a temperature sensor value, or return nil if it is not an object
+func decodeTemperature(value interface{}) *Temperature {
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	return &Temperature{
+		Celcius:          floatValue(fields["celcius"]),
+		Humidity:         floatValue(fields["humidity"]),
+		HeatindexCelcius: floatValue(fields["heatindexCelcius"]),
+	}
+}
+
+// Decode a soil sensor value, or return nil if it is not an object. The humidity samples are
+// nil unless they are all numbers.
+func decodeSoil(value interface{}) *Soil {
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	soil := &Soil{NumSamples: intValue(fields["numSamples"])}
+	if samples, ok := fields["humidity"].([]interface{}); ok {
+		humidity := make([]float64, 0, len(samples))
+		for _, sample := range samples {
+			f := floatValue(sample)
+			if f == nil {
+				humidity = nil
+				break
+			}
+			humidity = append(humidity, *f)
+		}
+		soil.Humidity = humidity
+	}
+	return soil
+}
+
+func (e Event) DecodedData() EventData {
+	decoded := EventData{Raw: e.Data}
+	for key, value := range e.Data {
+		switch key {
+		case "motion":
+			if motion, ok := value.(bool); ok {
+				decoded.Motion = &motion
+			}
+		case "temperature":
+			decoded.Temperature = decodeTemperature(value)
+		case "soil":
+			decoded.Soil = decodeSoil(value)
+		default:
+			if sensor, ok := scalarSensor(key); ok {
+				if v := sensor.decode(value); v != nil {
+					if decoded.Scalars == nil {
+						decoded.Scalars = make(map[string]interface{})
+					}
+					decoded.Scalars[key] = v
+				}
+				continue
+			}
+			if decoded.Other == nil {
+				decoded.Other = make(map[string]interface{})
+			}
+			decoded.Other[key] = value
+		}
+	}
+	return decoded
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package api
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestHeatIndex(t *testing.T) {
+	// Values of the NWS heat index chart, in fahrenheit, which are rounded to whole degrees
+	tests := []struct {
+		fahrenheit float64
+		humidity   float64
+		want       float64
+	}{
+		{70, 50, 69},
+		{80, 80, 84},
+		{86, 90, 105},
+		{90, 60, 100},
+		{90, 70, 106},
+		{100, 40, 109},
+	}
+	for _, test := range tests {
+		celcius := (test.fahrenheit - 32) * 5 / 9
+		got := HeatIndex(celcius, test.humidity)*9/5 + 32
+		if math.Abs(got-test.want) > 0.5 {
+			t.Errorf("heat index for %vF at %v%% is %.2fF, want %vF", test.fahrenheit, test.humidity, got, test.want)
+		}
+	}
+}
+
+func TestComputeHeatIndex(t *testing.T) {
+	celcius, humidity, sent := 32.0, 70.0, 30.0
+
+	temperature := Temperature{Celcius: &celcius, Humidity: &humidity}
+	temperature.ComputeHeatIndex()
+	if temperature.HeatindexCelcius == nil || math.Abs(*temperature.HeatindexCelcius-HeatIndex(celcius, humidity)) > 1e-9 {
+		t.Errorf("expected the heat index to be computed, got %v", temperature.HeatindexCelcius)
+	}
+
+	temperature = Temperature{Celcius: &celcius, Humidity: &humidity, HeatindexCelcius: &sent}
+	temperature.ComputeHeatIndex()
+	if *temperature.HeatindexCelcius != sent {
+		t.Errorf("expected the heat index sent by the device to be kept, got %v", *temperature.HeatindexCelcius)
+	}
+
+	temperature = Temperature{Celcius: &celcius}
+	temperature.ComputeHeatIndex()
+	if temperature.HeatindexCelcius != nil {
+		t.Errorf("expected no heat index without humidity, got %v", *temperature.HeatindexCelcius)
+	}
+}
+
+func TestScalarSensorDecode(t *testing.T) {
+	tests := []struct {
+		sensor string
+		value  interface{}
+		want   interface{}
+	}{
+		{"battery", 87.5, 87.5},
+		{"battery", json.Number("87.5"), 87.5},
+		{"battery", "full", nil},
+		{"light", 1200.0, 1200.0},
+		{"light", true, nil},
+		{"co2", 412.0, 412},
+		{"co2", json.Number("9007199254740993"), 9007199254740993},
+		{"co2", 412.5, nil},
+		{"co2", "412", nil},
+		{"pressure", 1013.25, 1013.25},
+		{"pressure", map[string]interface{}{"hPa": 1013.25}, nil},
+	}
+	for _, test := range tests {
+		sensor, ok := scalarSensor(test.sensor)
+		if !ok {
+			t.Fatalf("unknown sensor %s", test.sensor)
+		}
+		if got := sensor.decode(test.value); got != test.want {
+			t.Errorf("decoding %#v as %s gave %#v, want %#v", test.value, test.sensor, got, test.want)
+		}
+
+		// Values of the wrong type are left out of the decoded data, and kept in the raw data
+		e := Event{Data: map[string]interface{}{test.sensor: test.value}}
+		decoded := e.DecodedData()
+		got, found := decoded.Scalars[test.sensor]
+		if found != (test.want != nil) || (found && got != test.want) {
+			t.Errorf("decoded data of %#v as %s has %#v, want %#v", test.value, test.sensor, got, test.want)
+		}
+		if _, other := decoded.Other[test.sensor]; other {
+			t.Errorf("scalar sensor %s was decoded as other data", test.sensor)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+/*
+ * Copyright 2019, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package api
+
+import (
+	"context"
+)
+
+// Source of the events served by the API, implemented by the event cache, the replay event store and
+// the event database
+type EventStore interface {
+	// List the events matching the query
+	ListEvents(query EventQuery) ([]Event, error)
+	// List the events matching the query, along with the number of events matching before max is applied
+	ListEventsCounted(query EventQuery) (EventList, error)
+	// Returns the newest event for the given device, or nil if there is none
+	LatestEvent(deviceId string) (*Event, error)
+	// Returns the newest event of each of the devices, or of all devices with events if ids is empty
+	LatestPerDevice(ids []string) ([]Event, error)
+	// Call fn for each event matching the query, oldest first, until fn returns an error
+	StreamEvents(query EventQuery, fn func(Event) error) error
+	// Returns a page of up to max events after the cursor, all events if max is 0
+	ListEventsPaged(deviceId string, after string, max int) (EventPage, error)
+	// Compute statistics for a numeric field over the events of a device. An until of 0 means no upper bound.
+	EventStats(deviceId string, field string, since int64, until int64) (EventStats, error)
+	// Aggregate a numeric field over the events of a device into fixed size time buckets
+	EventSeries(query SeriesQuery) ([]SeriesPoint, error)
+	// Returns the state of the connection to the event store
+	State() ConnectionState
+}
+
+// Information about the events held in memory, implemented by the event cache
+type CacheInspector interface {
+	// Returns a summary of the cached events
+	Stats() CacheInfo
+	// Returns the newest event creation time seen for each device since startup
+	LastSeen() map[string]int64
+}
+
+// Source of the devices served by the API, implemented by the device registry client and the federated registry
+type DeviceSource interface {
+	ListDevices(ctx context.Context) ([]Device, error)
+	// Returns the device with the given id, or nil if there is none
+	GetDevice(ctx context.Context, id string) (*Device, error)
+	SetEnabled(ctx context.Context, id string, enabled bool) (Device, error)
+	Update(ctx context.Context, id string, patch DevicePatch) (Device, error)
+	// Check that the source is reachable, more cheaply than listing the devices
+	Ping(ctx context.Context) error
+}
@@ -4,16 +4,191 @@
  */
 package api
 
+import (
+	"encoding/json"
+	"fmt"
+)
+
 type Device struct {
 	ID          string   `json:"device-id"`
 	Enabled     bool     `json:"enabled"`
 	Name        string   `json:"name,omitempty"`
 	Description string   `json:"description,omitempty"`
 	Sensors     []string `json:"sensors,omitempty"`
+	// Type and unit of each sensor, when provided by the registry
+	SensorDetails []Sensor `json:"sensorDetails,omitempty"`
+	// Name of the device registry the device was listed by
+	Source string `json:"source,omitempty"`
+	// Labels assigned in the registry, such as the group or location of the device
+	Labels map[string]string `json:"labels,omitempty"`
+	// Other attributes provided by the registry, such as the firmware version
+	Metadata DeviceMetadata `json:"metadata,omitempty"`
+}
+
+// A sensor of a device. Type and unit are empty when not provided by the registry.
+type Sensor struct {
+	Name string `json:"name"`
+	Type string `json:"type,omitempty"`
+	Unit string `json:"unit,omitempty"`
+}
+
+// Decode a device, where sensors may be given by name or as sensor objects
+func (d *Device) UnmarshalJSON(data []byte) error {
+	type plainDevice Device
+	aux := struct {
+		*plainDevice
+		Sensors []json.RawMessage `json:"sensors"`
+	}{plainDevice: (*plainDevice)(d)}
+	err := json.Unmarshal(data, &aux)
+	if err != nil {
+		return err
+	}
+	if aux.Sensors == nil {
+		return nil
+	}
+	// Details given separately, as encoded by this package, take precedence
+	details := make([]Sensor, 0, len(aux.Sensors))
+	d.Sensors = make([]string, 0, len(aux.Sensors))
+	for _, raw := range aux.Sensors {
+		var sensor Sensor
+		if json.Unmarshal(raw, &sensor.Name) != nil {
+			err = json.Unmarshal(raw, &sensor)
+			if err != nil {
+				return fmt.Errorf("invalid sensor %s: %v", raw, err)
+			}
+		}
+		d.Sensors = append(d.Sensors, sensor.Name)
+		details = append(details, sensor)
+	}
+	if d.SensorDetails == nil {
+		d.SensorDetails = details
+	}
+	return nil
+}
+
+// Device attributes as strings. Registries may provide numbers, booleans or nested values,
+// which are kept in their JSON representation. Null values are dropped.
+type DeviceMetadata map[string]string
+
+func (m *DeviceMetadata) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	if raw == nil {
+		*m = nil
+		return nil
+	}
+	result := make(DeviceMetadata, len(raw))
+	for key, value := range raw {
+		if string(value) == "null" {
+			continue
+		}
+		var s string
+		if json.Unmarshal(value, &s) == nil {
+			result[key] = s
+		} else {
+			result[key] = string(value)
+		}
+	}
+	*m = result
+	return nil
+}
+
+// Changes to a device, fields that are nil are not sent to the registry
+type DevicePatch struct {
+	Name        *string `json:"name,omitempty"`
+	Description *string `json:"description,omitempty"`
+}
+
+type DevicePage struct {
+	TotalCount int      `json:"totalCount"`
+	Devices    []Device `json:"devices"`
 }
 
 type Event struct {
 	DeviceId     string                 `json:"deviceId"`
 	CreationTime int64                  `json:"creationTime"`
 	Data         map[string]interface{} `json:"data"`
+	// Event store topic the event was received from
+	Topic string `json:"topic,omitempty"`
+	// Creation times of later identical readings collapsed into this event, see CompactRepeats
+	Repeats []int64 `json:"repeats,omitempty"`
+	// Message properties and annotations captured on ingest, see MetaProperties
+	Meta map[string]interface{} `json:"meta,omitempty"`
+}
+
+type SortOrder string
+
+const (
+	Ascending  SortOrder = "ASC"
+	Descending SortOrder = "DESC"
+)
+
+// Events matching a query, with the number of matches before max was applied
+type EventList struct {
+	TotalCount int     `json:"totalCount"`
+	Events     []Event `json:"events"`
+}
+
+type EventEdge struct {
+	Cursor string `json:"cursor"`
+	Node   Event  `json:"node"`
+}
+
+type EventPage struct {
+	Edges       []EventEdge `json:"edges"`
+	EndCursor   string      `json:"endCursor"`
+	HasNextPage bool        `json:"hasNextPage"`
+}
+
+// Aggregate of a numeric event data field. Min, Max, Avg and Last are nil when Count is 0.
+type EventStats struct {
+	Count int      `json:"count"`
+	Min   *float64 `json:"min"`
+	Max   *float64 `json:"max"`
+	Avg   *float64 `json:"avg"`
+	Last  *float64 `json:"last"`
+}
+
+// How the values within a time bucket are combined
+type Aggregation string
+
+const (
+	AggregateAvg  Aggregation = "AVG"
+	AggregateLast Aggregation = "LAST"
+)
+
+// Query for a downsampled time series of a numeric event data field
+type SeriesQuery struct {
+	DeviceId string
+	Field    string
+	Since    int64
+	// Upper bound on the creation time, 0 means no upper bound
+	Until         int64
+	BucketSeconds int64
+	Aggregation   Aggregation
+	// Return empty buckets as points without a value instead of omitting them
+	IncludeEmpty bool
+}
+
+// Aggregated value of a time bucket starting at Time. Value is nil for an empty bucket.
+type SeriesPoint struct {
+	Time  int64    `json:"time"`
+	Value *float64 `json:"value"`
+}
+
+// Number of cached events for a device
+type DeviceEventCount struct {
+	DeviceId string `json:"deviceId"`
+	Count    int    `json:"count"`
+}
+
+// Summary of the events held in the event cache. Oldest and Newest are nil when the cache is empty.
+type CacheInfo struct {
+	TotalEvents int                `json:"totalEvents"`
+	Devices     []DeviceEventCount `json:"devices"`
+	Oldest      *int64             `json:"oldest"`
+	Newest      *int64             `json:"newest"`
 }